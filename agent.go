@@ -1,12 +1,14 @@
 package gorelic
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/courtf/go-metrics"
 	"github.com/courtf/newrelic_platform_go"
@@ -41,8 +43,26 @@ const (
 	//DefaultAgentName in NewRelic GUI. You can change it.
 	DefaultAgentName = "Go Plugin"
 
-	httpThroughPutDataSourceKey = "gorelic.http.throughput"
-	httpStatusDataSourceKey     = "gorelic.http.status." // add code to the end
+	// DefaultEndpoint is the NewRelic platform API URL metrics are sent to.
+	DefaultEndpoint = "https://platform-api.newrelic.com/platform/v1/metrics"
+
+	// DefaultPanicSamples - how many panics recovered from HTTP handlers are kept for Agent.Panics.
+	DefaultPanicSamples = 10
+
+	// DefaultSlowRequestSamples - how many slow HTTP requests are kept for Agent.SlowRequests.
+	DefaultSlowRequestSamples = 100
+
+	httpThroughPutDataSourceKey  = "gorelic.http.throughput"
+	httpConcurrencyDataSourceKey = "gorelic.http.concurrency"
+	httpBytesInDataSourceKey     = "gorelic.http.bytes.in"
+	httpBytesOutDataSourceKey    = "gorelic.http.bytes.out"
+	httpStatusDataSourceKey      = "gorelic.http.status."       // add code to the end
+	httpStatusClassDataSourceKey = "gorelic.http.status.class." // add class to the end, e.g. 5xx
+	httpStatusTotalDataSourceKey = "gorelic.http.status.total"
+	httpHijackedDataSourceKey    = "gorelic.http.hijacked"
+	httpPanicsDataSourceKey      = "gorelic.http.panics"
+	httpMethodDataSourceKey      = "gorelic.http.method." // add method to the end
+	httpErrorsDataSourceKey      = "gorelic.http.errors"
 )
 
 //Agent - is NewRelic agent implementation.
@@ -57,23 +77,115 @@ type Agent struct {
 	CollectMemoryStat           bool
 	CollectHTTPStat             bool
 	CollectHTTPStatuses         bool
+	CollectHTTPBytes            bool
+	CollectHTTPMethods          bool
+	HTTPStatusClassesOnly       bool
+	HTTPBytesPerRoute           bool
 	GCPollInterval              int
 	MemoryAllocatorPollInterval int
 	AgentGUID                   string
 	AgentVersion                string
 	plugin                      *newrelic_platform_go.NewrelicPlugin
 	HTTPTimer                   metrics.Timer
+	httpConcurrency             *httpConcurrency
+	httpStatuses                *httpStatuses
+	httpApdex                   *httpApdex
+	httpPanics                  *httpPanics
+	httpMethods                 atomic.Pointer[httpMethodTimers]
+	slowRequests                *slowRequests
+	transactions                *transactionTimers
 	Tracer                      *Tracer
 	CustomMetrics               []newrelic_platform_go.IMetrica
+	metricaSources              []MetricaSource
 	cmLk                        sync.Mutex
 	running                     uint32
+	component                   *component
+	// forcedStatuses is set once a middleware collects statuses with
+	// WithStatuses(true), so they are reported with CollectHTTPStatuses off
+	forcedStatuses uint32
+
+	// cfgLk guards the exported settings while ApplyConfig changes them, and
+	// settings holds the copy read by running loops.
+	cfgLk           sync.Mutex
+	settings        runtimeSettings
+	harvestLk       sync.Mutex
+	harvestFailures int
+	stats           agentStats
 
 	// All HTTP requests will be done using this client. Change it if you need
 	// to use a proxy.
 	Client http.Client
 
+	// TimerStats and HistogramStats select the statistics reported for HTTP
+	// and trace timers and for metrics created by NewTimer and NewHistogram.
+	TimerStats     TimerStats
+	HistogramStats HistogramStats
+
+	// Reservoir selects how HTTPTimer, trace timers and metrics created by
+	// NewTimer and NewHistogram sample values. Default value: exp-decay.
+	// Wrapped HTTP handlers do not allocate only with HDRReservoir or
+	// IntervalReservoir; exp-decay allocates on every update.
+	Reservoir Reservoir
+
+	// ApdexThreshold is the Apdex threshold T of wrapped HTTP handlers and
+	// traces. ApdexRouteThresholds (by Request.Pattern) and ApdexTraceThresholds
+	// (by trace name) override it. Apdex is reported only where a threshold is
+	// set; thresholds must be set before handlers are wrapped.
+	ApdexThreshold       time.Duration
+	ApdexRouteThresholds map[string]time.Duration
+	ApdexTraceThresholds map[string]time.Duration
+
+	// RecoverPanics makes wrapped HTTP handlers recover panics. They are
+	// counted under HTTP/Panics (and per route with PanicsPerRoute), recorded
+	// as 500 responses, even if the handler wrote another status first, and
+	// the last PanicSamples of them are kept for Panics. A 500 response is
+	// written unless RepanicAfterRecover is set, which makes the handler panic
+	// again once the panic is recorded and logged with its stack. These
+	// settings must be set before handlers are wrapped.
+	RecoverPanics       bool
+	RepanicAfterRecover bool
+	PanicsPerRoute      bool
+	PanicSamples        int
+
+	// SlowRequestThreshold makes requests to wrapped HTTP handlers taking
+	// longer than it recorded. The last SlowRequestSamples of them are kept
+	// for SlowRequests and, with LogSlowRequests, logged as warnings. Zero
+	// disables the slow request log.
+	SlowRequestThreshold time.Duration
+	SlowRequestSamples   int
+	LogSlowRequests      bool
+
+	// RequestTransactions makes wrapped HTTP handlers put a Transaction in
+	// the request context (see FromContext), to time segments of requests,
+	// mark them failed and add attributes to the slow request log. It must
+	// be set before handlers are wrapped.
+	RequestTransactions bool
+
+	// RetryPolicy controls retries of failed sends within a single harvest.
+	RetryPolicy RetryPolicy
+
+	// Endpoint is the URL metrics are sent to. Change it to report to a proxy
+	// or to a fake collector in tests (see package gorelictest).
+	Endpoint string
+
+	// AfterHarvest is called after every harvest, once the response was
+	// handled (sent data is cleared by then), with the error of the harvest,
+	// if any. It must be set before Run and must not call Flush or Harvest.
+	AfterHarvest func(err error)
+
+	// Clock drives harvests, capture loops, HTTP and trace timers. It must be
+	// set before Run. If it is nil, SystemClock is used.
+	Clock Clock
+
+	// Logger receives agent messages: collector init, harvest results, send
+	// failures and metric errors. If it is nil, messages are written to stderr,
+	// and debug messages only while Verbose is on.
+	Logger            *slog.Logger
+	defaultLogger     *slog.Logger
+	defaultLoggerOnce sync.Once
+
 	// data source for internal use
-	dataSource DataSource
+	dataSource LabeledDataSource
 }
 
 // NewAgent builds new Agent objects.
@@ -91,69 +203,139 @@ func NewAgent() *Agent {
 		AgentVersion:                CurrentAgentVersion,
 		Tracer:                      nil,
 		CustomMetrics:               make([]newrelic_platform_go.IMetrica, 0),
-		dataSource:                  NewDataSource(metrics.NewRegistry()),
+		TimerStats:                  DefaultTimerStats,
+		HistogramStats:              DefaultHistogramStats,
+		RetryPolicy:                 DefaultRetryPolicy,
+		PanicSamples:                DefaultPanicSamples,
+		SlowRequestSamples:          DefaultSlowRequestSamples,
+		Endpoint:                    DefaultEndpoint,
 	}
+	agent.dataSource = NewDataSourceWithOptions(metrics.NewRegistry(), DataSourceOptions{
+		Clock: agentClock{agent},
+		// series created on first use, e.g. sizes per route, sample with Agent.Reservoir too
+		NewSample: func() metrics.Sample { return agent.newSample(agent.Reservoir) },
+	})
+	agent.stats.clock = clockOf(agent.dataSource)
 	return agent
 }
 
-// used by proxyWrapper below to record http statuses
-type statusRecorder struct {
-	http.ResponseWriter
-	agent       *Agent
-	wroteHeader bool
+type proxyWrapper struct {
+	*tHTTPHandler
+	agent *Agent
+	// route names the route of a request once it is served
+	route func(*http.Request) string
+	// statuses overrides CollectHTTPStatuses for this handler when set
+	statuses *bool
 }
 
-func (sr *statusRecorder) WriteHeader(status int) {
-	sr.wroteHeader = true
-	go sr.agent.dataSource.IncCounterForKey(statusKeyFunc(status), 1)
-	sr.ResponseWriter.WriteHeader(status)
-}
+func (pw proxyWrapper) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	statuses, bytes, apdex := pw.agent.settings.httpStatusesEnabled(), pw.agent.settings.httpBytesEnabled(), pw.agent.httpApdex.enabled()
+	if pw.statuses != nil {
+		statuses = *pw.statuses
+	}
 
-func (sr *statusRecorder) Write(b []byte) (int, error) {
-	if !sr.wroteHeader {
-		sr.WriteHeader(http.StatusOK)
+	var txn *Transaction
+	if pw.agent.RequestTransactions {
+		txn = newTransaction(clockOf(pw.agent.dataSource))
+		req = req.WithContext(context.WithValue(req.Context(), transactionKey{}, txn))
 	}
 
-	return sr.ResponseWriter.Write(b)
-}
+	var body *countingReader
+	if bytes && req.ContentLength < 0 && req.Body != nil {
+		body = &countingReader{ReadCloser: req.Body}
+		req.Body = body
+	}
 
-type proxyWrapper struct {
-	*tHTTPHandler
-	agent *Agent
-}
+	// the recorder exposes the same optional interfaces (http.Flusher,
+	// http.Hijacker...) as w, so it is used even if nothing is recorded
+	sr := getStatusRecorder(w, pw.agent, statuses)
+	defer putStatusRecorder(sr)
+	d, p := pw.tHTTPHandler.serve(sr.wrap(), req, pw.agent.RecoverPanics)
+
+	// routers fill in the route while serving, so it is named afterwards, and
+	// only if it is needed
+	slow := pw.agent.SlowRequestThreshold > 0 && d > pw.agent.SlowRequestThreshold && !sr.hijacked
+	var route string
+	if p != nil || apdex || slow || bytes && pw.agent.HTTPBytesPerRoute || txn.hasSegments() {
+		route = pw.route(req)
+		if name := txn.Name(); name != "" {
+			route = name
+		}
+	}
+	failed := txn.Err() != nil
+	if failed {
+		pw.agent.dataSource.IncCounterForKey(httpErrorsDataSourceKey, 1)
+	}
+	if txn != nil {
+		pw.agent.transactions.record(route, txn)
+	}
 
-func (pw proxyWrapper) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	pw.tHTTPHandler.ServeHTTP(&statusRecorder{w, pw.agent, false}, req)
-}
+	if p != nil {
+		pw.agent.httpPanics.record(p, route)
+		if !sr.hijacked {
+			if !sr.wroteHeader && !pw.agent.RepanicAfterRecover {
+				http.Error(sr, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			} else {
+				// the response is aborted or cut short, but it still counts as a 500
+				sr.failStatus()
+			}
+		}
+	}
 
-//WrapHTTPHandlerFunc  instrument HTTP handler functions to collect HTTP metrics
-func (agent *Agent) WrapHTTPHandlerFunc(h tHTTPHandlerFunc) tHTTPHandlerFunc {
-	agent.CollectHTTPStat = true
-	agent.initTimer()
-	proxy := newHTTPHandlerFunc(h)
-	proxy.timer = agent.HTTPTimer
+	if apdex && !sr.hijacked {
+		// 5xx responses, panics and errors are frustrating whatever their duration
+		pw.agent.httpApdex.record(route, d, failed || p != nil || sr.status >= http.StatusInternalServerError)
+	}
 
-	if agent.CollectHTTPStatuses {
-		pr := proxyWrapper{proxy, agent}
-		return pr.ServeHTTP
+	if methods := pw.agent.httpMethods.Load(); methods != nil {
+		methods.update(req.Method, d)
 	}
+	if slow {
+		pw.agent.recordSlowRequest(req, route, sr.status, d, txn)
+	}
+
+	if bytes {
+		in := req.ContentLength
+		if body != nil {
+			in = body.read
+		}
+		if !pw.agent.HTTPBytesPerRoute {
+			route = ""
+		}
+		recordHTTPBytes(pw.agent.dataSource, in, sr.written, route)
+	}
+
+	if p != nil && pw.agent.RepanicAfterRecover {
+		// panicking again loses the stack of the original panic
+		pw.agent.logger().Error("panic in HTTP handler", "route", route, "panic", fmt.Sprint(p.value),
+			"stack", string(p.stack))
+		panic(p.value)
+	}
+}
 
-	return proxy.ServeHTTP
+//WrapHTTPHandlerFunc  instrument HTTP handler functions to collect HTTP metrics
+func (agent *Agent) WrapHTTPHandlerFunc(h tHTTPHandlerFunc) tHTTPHandlerFunc {
+	return agent.wrapHTTPHandler(http.HandlerFunc(h)).ServeHTTP
 }
 
 //WrapHTTPHandler  instrument HTTP handler object to collect HTTP metrics
 func (agent *Agent) WrapHTTPHandler(h http.Handler) http.Handler {
+	return agent.wrapHTTPHandler(h)
+}
+
+func (agent *Agent) wrapHTTPHandler(h http.Handler) proxyWrapper {
 	agent.CollectHTTPStat = true
 	agent.initTimer()
+	agent.initStatusCounters()
 
 	proxy := newHTTPHandler(h)
 	proxy.timer = agent.HTTPTimer
+	proxy.concurrency = agent.httpConcurrency
+	proxy.clock = clockOf(agent.dataSource)
 
-	if agent.CollectHTTPStatuses {
-		return proxyWrapper{proxy, agent}
-	}
-
-	return proxy
+	// statuses and sizes are recorded only while CollectHTTPStatuses and
+	// CollectHTTPBytes are on, which may change at runtime
+	return proxyWrapper{tHTTPHandler: proxy, agent: agent, route: requestPattern}
 }
 
 //AddCustomMetric adds metric to be collected periodically with NewrelicPollInterval interval
@@ -168,54 +350,113 @@ func (agent *Agent) AddCustomMetric(metric newrelic_platform_go.IMetrica) {
 	}
 }
 
+// AddMetricaSource adds metricas created at runtime, e.g. LabeledMetricas,
+// to be collected periodically with NewrelicPollInterval interval.
+func (agent *Agent) AddMetricaSource(source MetricaSource) {
+	agent.cmLk.Lock()
+	defer agent.cmLk.Unlock()
+	agent.metricaSources = append(agent.metricaSources, source)
+
+	if atomic.LoadUint32(&agent.running) > 0 {
+		agent.component.addSource(source)
+	}
+}
+
 //Run initialize Agent instance and start harvest go routine
 func (agent *Agent) Run() error {
 	if agent.NewrelicLicense == "" {
 		return errors.New("please, pass a valid newrelic license key")
 	}
 
-	agent.plugin = newrelic_platform_go.NewNewrelicPlugin(agent.AgentVersion, agent.NewrelicLicense, agent.NewrelicPollInterval, agent.NewRelicFatalThreshold)
-	agent.plugin.Client = agent.Client
+	agent.cfgLk.Lock()
+	agent.settings.sync(agent)
+	agent.cfgLk.Unlock()
 
-	var component newrelic_platform_go.IComponent
-	component = newrelic_platform_go.NewPluginComponent(agent.NewrelicName, agent.AgentGUID)
+	agent.component = newComponent(agent.NewrelicName, agent.AgentGUID, agent.metricaError)
+	var component newrelic_platform_go.IComponent = agent.component
 
 	// Add default metrics and tracer.
-	addRuntimeMetricsToComponent(component)
-	agent.Tracer = newTracer(component, agent.dataSource)
-
-	// Check agent flags and add relevant metrics.
+	addRuntimeMetricsToComponent(component, clockOf(agent.dataSource))
+	addSelfMetricsToComponent(component, &agent.stats)
+	agent.Tracer = newTracer(component, agent.dataSource, agent.TimerStats, func() metrics.Timer {
+		return agent.newTimer(agent.Reservoir)
+	}, agent.traceApdexThreshold)
+
+	// GC, memory and HTTP status collectors can be switched on and off by ApplyConfig,
+	// so they are always set up and only report while enabled.
+	addGCMetricsToComponent(toggledComponent{component, agent.settings.gcEnabled}, agent.dataSource)
+	go agent.pollLoop(agent.settings.gcInterval, agent.settings.gcEnabled, func() {
+		metrics.CaptureDebugGCStatsOnce(agent.dataSource)
+	})
 	if agent.CollectGcStat {
-		addGCMetricsToComponent(component, agent.dataSource, agent.GCPollInterval)
-		agent.debug(fmt.Sprintf("Init GC metrics collection. Poll interval %d seconds.", agent.GCPollInterval))
+		agent.logger().Debug("init GC metrics collection", "poll_interval", agent.GCPollInterval)
 	}
 
+	addMemoryMetricsToComponent(toggledComponent{component, agent.settings.memoryEnabled}, agent.dataSource)
 	if agent.CollectMemoryStat {
-		addMemoryMetricsToComponent(component, agent.dataSource, agent.MemoryAllocatorPollInterval)
-		agent.debug(fmt.Sprintf("Init memory allocator metrics collection. Poll interval %d seconds.", agent.MemoryAllocatorPollInterval))
+		metrics.CaptureRuntimeMemStatsOnce(agent.dataSource)
+		agent.logger().Debug("init memory allocator metrics collection", "poll_interval", agent.MemoryAllocatorPollInterval)
 	}
+	go agent.pollLoop(agent.settings.memoryInterval, agent.settings.memoryEnabled, func() {
+		metrics.CaptureRuntimeMemStatsOnce(agent.dataSource)
+	})
 
 	if agent.CollectHTTPStat {
 		agent.initTimer()
-		addHTTPMetricsToComponent(component, agent.dataSource, httpThroughPutDataSourceKey)
-		agent.debug(fmt.Sprintf("Init HTTP metrics collection."))
+		addHTTPMetricsToComponent(component, agent.dataSource, httpThroughPutDataSourceKey, agent.TimerStats)
+		addHTTPConcurrencyMetricsToComponent(component, agent.dataSource, agent.httpConcurrency, agent.HistogramStats)
+		if agent.CollectHTTPMethods {
+			addHTTPMethodMetricsToComponent(component, agent.dataSource, agent.TimerStats)
+		}
+		component.AddMetrica(NewCounterMetrica(agent.dataSource, httpHijackedDataSourceKey, "HTTP/Hijacked", "connections"))
+		if agent.httpApdex.enabled() {
+			addHTTPApdexMetricsToComponent(component, agent.httpApdex)
+		}
+		if agent.RequestTransactions {
+			component.AddMetrica(NewCounterMetrica(agent.dataSource, httpErrorsDataSourceKey, "HTTP/Errors", "errors"))
+			agent.component.addSource(agent.transactions)
+		}
+		if agent.RecoverPanics {
+			component.AddMetrica(NewCounterMetrica(agent.dataSource, httpPanicsDataSourceKey, "HTTP/Panics", "panics"))
+			if agent.PanicsPerRoute {
+				agent.component.addSource(httpPanicsPerRouteSource(agent.dataSource))
+			}
+		}
+		agent.initBytes()
+		addHTTPBytesMetricsToComponent(toggledComponent{component, agent.settings.httpBytesEnabled}, agent.dataSource, agent.HistogramStats)
+		if agent.HTTPBytesPerRoute {
+			for _, source := range httpBytesPerRouteSources(agent.dataSource, agent.HistogramStats) {
+				agent.component.addSource(source)
+			}
+		}
+		agent.logger().Debug("init HTTP metrics collection")
 	}
 
+	agent.initStatusCounters()
+	statuses := getHTTPStatuses()
+	if agent.HTTPStatusClassesOnly {
+		statuses = nil
+	}
+	addHTTPStatusMetricsToComponent(toggledComponent{component, agent.httpStatusesReported}, agent.dataSource, statuses, statusKeyFunc)
+	agent.component.addSource(agent.httpStatuses)
 	if agent.CollectHTTPStatuses {
-		statuses := getHTTPStatuses()
-		agent.initStatusCounters(statuses)
-		addHTTPStatusMetricsToComponent(component, agent.dataSource, statuses, statusKeyFunc)
-		agent.debug(fmt.Sprintf("Init HTTP status metrics collection."))
+		agent.logger().Debug("init HTTP status metrics collection")
 	}
 
 	// Init newrelic reporting plugin.
 	agent.plugin = newrelic_platform_go.NewNewrelicPlugin(agent.AgentVersion, agent.NewrelicLicense, agent.NewrelicPollInterval, agent.NewRelicFatalThreshold)
-	agent.plugin.Verbose = agent.Verbose
+	agent.plugin.Client = agent.Client
+	if agent.Endpoint != "" {
+		agent.plugin.URL = agent.Endpoint
+	}
 
 	agent.cmLk.Lock()
 	for _, metric := range agent.CustomMetrics {
 		component.AddMetrica(metric)
-		agent.debug(fmt.Sprintf("Init %s metric collection.", metric.GetName()))
+		agent.logger().Debug("init custom metric collection", "metric", metric.GetName())
+	}
+	for _, source := range agent.metricaSources {
+		agent.component.addSource(source)
 	}
 
 	// Add our metrics component to the plugin.
@@ -225,23 +466,75 @@ func (agent *Agent) Run() error {
 	agent.cmLk.Unlock()
 
 	// Start reporting!
-	agent.plugin.Run()
+	go func() {
+		agent.harvest()
+		agent.pollLoop(agent.settings.harvestInterval, func() bool { return true }, func() { agent.harvest() })
+	}()
 	return nil
 }
 
-//Initialize global metrics.Timer object, used to collect HTTP metrics
+//Initialize global metrics.Timer object, concurrency tracking, Apdex, panic, method and transaction metrics, used to collect HTTP metrics
+// Wrapping a handler creates them, except method timers, which Run creates if
+// CollectHTTPMethods was turned on afterwards. Handlers may be serving by then,
+// so they load method timers atomically.
 func (agent *Agent) initTimer() {
 	if agent.HTTPTimer == nil {
-		agent.HTTPTimer = metrics.NewTimer()
+		agent.HTTPTimer = agent.newTimer(agent.Reservoir)
 		agent.dataSource.Register(httpThroughPutDataSourceKey, agent.HTTPTimer)
 	}
+	if agent.httpConcurrency == nil {
+		agent.httpConcurrency = &httpConcurrency{histogram: newHistogram(agent.newSample(agent.Reservoir))}
+		agent.dataSource.Register(httpConcurrencyDataSourceKey, agent.httpConcurrency.histogram)
+	}
+	if agent.httpApdex == nil {
+		agent.httpApdex = newHTTPApdex(agent.dataSource, agent.ApdexThreshold, agent.ApdexRouteThresholds)
+	}
+	if agent.httpPanics == nil {
+		agent.httpPanics = newHTTPPanics(agent.dataSource, agent.PanicsPerRoute, agent.PanicSamples)
+	}
+	if agent.CollectHTTPMethods && agent.httpMethods.Load() == nil {
+		methods := newHTTPMethodTimers(agent.dataSource, func() metrics.Timer { return agent.newTimer(agent.Reservoir) })
+		agent.httpMethods.Store(&methods)
+	}
+	if agent.slowRequests == nil {
+		agent.slowRequests = &slowRequests{size: agent.SlowRequestSamples}
+	}
+	if agent.transactions == nil {
+		agent.transactions = newTransactionTimers(agent.dataSource, agent.TimerStats, func() metrics.Timer { return agent.newTimer(agent.Reservoir) })
+		agent.dataSource.Register(httpErrorsDataSourceKey, metrics.NewCounter())
+	}
+	agent.dataSource.Register(httpHijackedDataSourceKey, metrics.NewCounter())
+}
+
+// traceApdexThreshold returns the Apdex threshold of trace name, zero if Apdex
+// is not reported for it.
+func (agent *Agent) traceApdexThreshold(name string) time.Duration {
+	if threshold, ok := agent.ApdexTraceThresholds[name]; ok {
+		return threshold
+	}
+	return agent.ApdexThreshold
+}
+
+//Initialize histograms and meters used to collect HTTP request and response sizes
+func (agent *Agent) initBytes() {
+	for _, key := range []string{httpBytesInDataSourceKey, httpBytesOutDataSourceKey} {
+		agent.dataSource.Register(key, newHistogram(agent.newSample(agent.Reservoir)))
+		agent.dataSource.Register(key+httpBytesRateSuffix, metrics.NewMeter())
+	}
 }
 
 //Initialize metrics.Counters objects, used to collect HTTP statuses
-func (agent *Agent) initStatusCounters(statuses []int) {
-	for _, statusCode := range statuses {
-		agent.dataSource.Register(statusKeyFunc(statusCode), metrics.NewCounter())
+func (agent *Agent) initStatusCounters() {
+	if agent.httpStatuses != nil {
+		return
 	}
+	agent.httpStatuses = newHTTPStatuses(agent.dataSource, !agent.HTTPStatusClassesOnly, agent.httpStatusesReported, getHTTPStatuses())
+}
+
+// httpStatusesReported tells whether status metrics are reported: while
+// CollectHTTPStatuses is on, or always once a middleware collects them.
+func (agent *Agent) httpStatusesReported() bool {
+	return agent.settings.httpStatusesEnabled() || atomic.LoadUint32(&agent.forcedStatuses) > 0
 }
 
 func getHTTPStatuses() []int {
@@ -269,9 +562,8 @@ func statusKeyFunc(status int) string {
 	return httpStatusDataSourceKey + fmt.Sprintf("%d", status)
 }
 
-//Print debug messages
-func (agent *Agent) debug(msg string) {
-	if agent.Verbose {
-		log.Println(msg)
-	}
+// metricaError is called by the component for every metrica which failed to return a value.
+func (agent *Agent) metricaError(metrica newrelic_platform_go.IMetrica, err error) {
+	agent.stats.metricaError()
+	agent.logger().Debug("can not get metric value", "metric", metrica.GetName(), "error", err)
 }
@@ -0,0 +1,185 @@
+package gorelic
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// AggregateMetrica is a metrica reporting a whole distribution as a single
+// NewRelic metric: {total, count, min, max, sum_of_squares}. GetValue returns
+// the mean of the distribution.
+type AggregateMetrica interface {
+	newrelic_platform_go.IMetrica
+	GetAggregateValue() (*newrelic_platform_go.AggregatedMetricaValue, error)
+}
+
+// aggregate builds an aggregated value of count values from their mean and
+// variance, dividing every value by scale.
+func aggregate(count int64, min, max int64, mean, variance, scale float64) *newrelic_platform_go.AggregatedMetricaValue {
+	if count <= 0 {
+		return &newrelic_platform_go.AggregatedMetricaValue{}
+	}
+	mean /= scale
+	variance /= scale * scale
+	return &newrelic_platform_go.AggregatedMetricaValue{
+		Min:          float64(min) / scale,
+		Max:          float64(max) / scale,
+		Total:        mean * float64(count),
+		Count:        int(count),
+		SumOfSquares: float64(count) * (variance + mean*mean),
+	}
+}
+
+// mergeAggregates adds the values of b to a.
+func mergeAggregates(a, b *newrelic_platform_go.AggregatedMetricaValue) {
+	if b.Count == 0 {
+		return
+	}
+	if a.Count == 0 {
+		*a = *b
+		return
+	}
+	a.Min = math.Min(a.Min, b.Min)
+	a.Max = math.Max(a.Max, b.Max)
+	a.Total += b.Total
+	a.Count += b.Count
+	a.SumOfSquares += b.SumOfSquares
+}
+
+// sentCount remembers the sample count of the last harvest that was sent, so
+// that timers and histograms without IntervalReservoir, whose counts grow for
+// their whole life, are reported per harvest too.
+type sentCount struct {
+	sent, read int64
+	hasRead    bool
+}
+
+// delta returns the number of values added since the last sent harvest. The
+// values of a non interval sample are reported only count times, from its
+// mean and variance.
+func (c *sentCount) delta(count int64) int64 {
+	if count < c.sent {
+		// the metric was cleared
+		c.sent = 0
+	}
+	c.read, c.hasRead = count, true
+	return count - c.sent
+}
+
+// clear marks the last read count as sent.
+func (c *sentCount) clear() {
+	if c.hasRead {
+		c.sent, c.hasRead = c.read, false
+	}
+}
+
+// aggregateCount returns the number of values of m to report: all of them for
+// interval samples, which are reset every harvest, those added since the last
+// sent harvest for others.
+func aggregateCount(m interface{}, count int64, sent *sentCount) int64 {
+	if intervalOf(m) != nil {
+		return count
+	}
+	return sent.delta(count)
+}
+
+func aggregateMean(value *newrelic_platform_go.AggregatedMetricaValue) float64 {
+	if value.Count == 0 {
+		return 0
+	}
+	return value.Total / float64(value.Count)
+}
+
+// TimerAggregateMetrica reports a timer as one aggregate metric in milliseconds.
+// Count and total cover the values added since the last harvest that was sent.
+// Min, max and the mean come from the timer's sample, so use IntervalReservoir
+// to get them per harvest too.
+type TimerAggregateMetrica struct {
+	baseMetrica
+	sent *sentCount
+}
+
+func NewTimerAggregateMetrica(ds DataSource, dataSourceKey, path string) TimerAggregateMetrica {
+	return TimerAggregateMetrica{
+		baseMetrica{
+			ds, dataSourceKey, path, "ms",
+		},
+		&sentCount{},
+	}
+}
+
+func (metrica TimerAggregateMetrica) GetAggregateValue() (*newrelic_platform_go.AggregatedMetricaValue, error) {
+	if valueContainer := metrica.dataSource.Get(metrica.dataSourceKey); valueContainer == nil {
+		return nil, fmt.Errorf("metrica with name %s is not registered\n", metrica.dataSourceKey)
+	} else if timer, ok := valueContainer.(metrics.Timer); ok {
+		count := aggregateCount(timer, timer.Count(), metrica.sent)
+		return aggregate(count, timer.Min(), timer.Max(), timer.Mean(), timer.Variance(), float64(time.Millisecond)), nil
+	} else {
+		return nil, fmt.Errorf("metrica container has unexpected type: %T\n", valueContainer)
+	}
+}
+
+func (metrica TimerAggregateMetrica) GetValue() (float64, error) {
+	value, err := metrica.GetAggregateValue()
+	if err != nil {
+		return 0, err
+	}
+	return aggregateMean(value), nil
+}
+
+func (metrica TimerAggregateMetrica) startHarvest(seq uint64) {
+	metrica.rotateInterval(seq)
+}
+
+func (metrica TimerAggregateMetrica) ClearSentData() {
+	metrica.sent.clear()
+	metrica.clearInterval()
+}
+
+// HistogramAggregateMetrica reports a histogram as one aggregate metric, per
+// harvest like TimerAggregateMetrica.
+type HistogramAggregateMetrica struct {
+	baseMetrica
+	sent *sentCount
+}
+
+func NewHistogramAggregateMetrica(ds DataSource, dataSourceKey, path, units string) HistogramAggregateMetrica {
+	return HistogramAggregateMetrica{
+		baseMetrica{
+			ds, dataSourceKey, path, units,
+		},
+		&sentCount{},
+	}
+}
+
+func (metrica HistogramAggregateMetrica) GetAggregateValue() (*newrelic_platform_go.AggregatedMetricaValue, error) {
+	if valueContainer := metrica.dataSource.Get(metrica.dataSourceKey); valueContainer == nil {
+		return nil, fmt.Errorf("metrica with name %s is not registered\n", metrica.dataSourceKey)
+	} else if histogram, ok := valueContainer.(metrics.Histogram); ok {
+		count := aggregateCount(histogram, histogram.Count(), metrica.sent)
+		return aggregate(count, histogram.Min(), histogram.Max(), histogram.Mean(), histogram.Variance(), 1), nil
+	} else {
+		return nil, fmt.Errorf("metrica container has unexpected type: %T\n", valueContainer)
+	}
+}
+
+func (metrica HistogramAggregateMetrica) GetValue() (float64, error) {
+	value, err := metrica.GetAggregateValue()
+	if err != nil {
+		return 0, err
+	}
+	return aggregateMean(value), nil
+}
+
+func (metrica HistogramAggregateMetrica) startHarvest(seq uint64) {
+	metrica.rotateInterval(seq)
+}
+
+func (metrica HistogramAggregateMetrica) ClearSentData() {
+	metrica.sent.clear()
+	metrica.clearInterval()
+}
@@ -0,0 +1,73 @@
+package gorelic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestTimerAggregateMetricaPerHarvest(t *testing.T) {
+	for _, kind := range []ReservoirKind{ExpDecayReservoir, UniformReservoir, SlidingWindowReservoir, HDRReservoir, IntervalReservoir} {
+		ds := NewDataSource(metrics.NewRegistry())
+		timer := NewTimerWithReservoir(Reservoir{Kind: kind}, SystemClock)
+		ds.Register("t", timer)
+		metrica := NewTimerAggregateMetrica(ds, "t", "T")
+
+		var seq uint64
+		harvest := func(want int, sent bool) {
+			t.Helper()
+			seq++
+			metrica.startHarvest(seq)
+			value, err := metrica.GetAggregateValue()
+			if err != nil || value.Count != want {
+				t.Errorf("reservoir %v, harvest %d: got %+v, %v, want count %d", kind, seq, value, err, want)
+			}
+			if sent {
+				metrica.ClearSentData()
+			}
+		}
+		update := func(n int) {
+			for i := 0; i < n; i++ {
+				timer.Update(time.Millisecond)
+			}
+		}
+
+		update(10)
+		harvest(10, true)
+		update(10)
+		harvest(10, true)
+		harvest(0, true)
+		update(10)
+		// values of a failed harvest are reported with the next one
+		harvest(10, false)
+		update(5)
+		harvest(15, true)
+	}
+}
+
+func TestHistogramAggregateMetricaPerHarvest(t *testing.T) {
+	ds := NewDataSource(metrics.NewRegistry())
+	histogram := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	ds.Register("h", histogram)
+	metrica := NewHistogramAggregateMetrica(ds, "h", "H", "bytes")
+
+	for i := 1; i <= 4; i++ {
+		histogram.Update(100)
+	}
+	if value, _ := metrica.GetAggregateValue(); value.Count != 4 || value.Total != 400 {
+		t.Errorf("got %+v, want count 4, total 400", value)
+	}
+	metrica.ClearSentData()
+	histogram.Update(100)
+	if value, _ := metrica.GetAggregateValue(); value.Count != 1 || value.Total != 100 {
+		t.Errorf("got %+v, want count 1, total 100", value)
+	}
+	// a cleared histogram starts counting again
+	metrica.ClearSentData()
+	histogram.Clear()
+	histogram.Update(100)
+	if value, _ := metrica.GetAggregateValue(); value.Count != 1 {
+		t.Errorf("got %+v after Clear, want count 1", value)
+	}
+}
@@ -0,0 +1,154 @@
+package gorelic
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/newrelic_platform_go"
+)
+
+const apdexDataSourceKey = "gorelic.apdex." // add http, route or trace name to the end
+
+const (
+	apdexSatisfied = iota
+	apdexTolerating
+	apdexFrustrated
+)
+
+var apdexZones = []string{"Satisfied", "Tolerating", "Frustrated"}
+
+// apdexZone classifies a response time d with threshold t: satisfied up to t,
+// tolerating up to 4t, frustrated above 4t or when the request failed.
+func apdexZone(d, t time.Duration, failed bool) int {
+	switch {
+	case failed || d > 4*t:
+		return apdexFrustrated
+	case d > t:
+		return apdexTolerating
+	}
+	return apdexSatisfied
+}
+
+// apdexCounters counts responses by Apdex zone. The counters are reset after
+// every successful harvest, so the score covers the harvest interval.
+type apdexCounters struct {
+	ds       DataSource
+	key      string
+	counters [3]metrics.Counter
+}
+
+func newApdexCounters(ds DataSource, key string) *apdexCounters {
+	a := &apdexCounters{ds: ds, key: key}
+	for zone := range apdexZones {
+		a.counters[zone] = metrics.NewCounter()
+		ds.Register(a.zoneKey(zone), a.counters[zone])
+	}
+	return a
+}
+
+func (a *apdexCounters) zoneKey(zone int) string {
+	return a.key + "." + apdexZones[zone]
+}
+
+func (a *apdexCounters) record(zone int) {
+	a.counters[zone].Inc(1)
+}
+
+// metricas returns the counters of every zone and the score, reported under
+// basePath. units are used for the counters.
+func (a *apdexCounters) metricas(basePath, units string) []newrelic_platform_go.IMetrica {
+	ret := []newrelic_platform_go.IMetrica{apdexScoreMetrica{a, filepath.Join(basePath, "Score")}}
+	for zone, name := range apdexZones {
+		ret = append(ret, NewCounterMetrica(a.ds, a.zoneKey(zone), filepath.Join(basePath, name), units))
+	}
+	return ret
+}
+
+// apdexScoreMetrica reports (satisfied + tolerating/2) / total of the harvest
+// interval. Intervals without responses are not reported.
+type apdexScoreMetrica struct {
+	apdex *apdexCounters
+	path  string
+}
+
+func (metrica apdexScoreMetrica) GetName() string {
+	return metrica.path
+}
+func (metrica apdexScoreMetrica) GetUnits() string {
+	return "score"
+}
+func (metrica apdexScoreMetrica) GetValue() (float64, error) {
+	var counts [3]float64
+	for zone := range apdexZones {
+		count, err := metrica.apdex.ds.GetCounterValue(metrica.apdex.zoneKey(zone))
+		if err != nil {
+			return 0, err
+		}
+		counts[zone] = count
+	}
+	total := counts[apdexSatisfied] + counts[apdexTolerating] + counts[apdexFrustrated]
+	if total == 0 {
+		return 0, errNoValue
+	}
+	return (counts[apdexSatisfied] + counts[apdexTolerating]/2) / total, nil
+}
+func (metrica apdexScoreMetrica) ClearSentData() {
+	// the counters are cleared by their own metricas
+}
+
+// httpApdex classifies responses of wrapped handlers by the threshold of their
+// route, or by Agent.ApdexThreshold for routes without one. Every response is
+// counted in Apdex/ and, if its route has a threshold, in Apdex/route/<route>/.
+type httpApdex struct {
+	threshold time.Duration
+	all       *apdexCounters
+	routes    map[string]*routeApdex
+}
+
+type routeApdex struct {
+	threshold time.Duration
+	counters  *apdexCounters
+}
+
+func newHTTPApdex(ds DataSource, threshold time.Duration, routes map[string]time.Duration) *httpApdex {
+	a := &httpApdex{
+		threshold: threshold,
+		all:       newApdexCounters(ds, apdexDataSourceKey+"http"),
+		routes:    make(map[string]*routeApdex, len(routes)),
+	}
+	for route, t := range routes {
+		if t <= 0 {
+			continue
+		}
+		a.routes[route] = &routeApdex{t, newApdexCounters(ds, fmt.Sprintf("%sroute.%s", apdexDataSourceKey, route))}
+	}
+	return a
+}
+
+// enabled reports whether any threshold is set.
+func (a *httpApdex) enabled() bool {
+	return a != nil && (a.threshold > 0 || len(a.routes) > 0)
+}
+
+func (a *httpApdex) record(route string, d time.Duration, failed bool) {
+	if r, ok := a.routes[route]; ok {
+		zone := apdexZone(d, r.threshold, failed)
+		r.counters.record(zone)
+		a.all.record(zone)
+	} else if a.threshold > 0 {
+		a.all.record(apdexZone(d, a.threshold, failed))
+	}
+}
+
+func addHTTPApdexMetricsToComponent(component newrelic_platform_go.IComponent, apdex *httpApdex) {
+	for _, m := range apdex.all.metricas("Apdex", "requests") {
+		component.AddMetrica(m)
+	}
+	for route, r := range apdex.routes {
+		for _, m := range r.counters.metricas(filepath.Join("Apdex/route", pathSegment(route)), "requests") {
+			component.AddMetrica(m)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package gorelic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestApdexZone(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	tests := []struct {
+		d      time.Duration
+		failed bool
+		want   int
+	}{
+		{0, false, apdexSatisfied},
+		{threshold, false, apdexSatisfied},
+		{threshold + 1, false, apdexTolerating},
+		{4 * threshold, false, apdexTolerating},
+		{4*threshold + 1, false, apdexFrustrated},
+		{time.Minute, false, apdexFrustrated},
+		{0, true, apdexFrustrated},
+		{threshold, true, apdexFrustrated},
+	}
+	for _, tt := range tests {
+		if got := apdexZone(tt.d, threshold, tt.failed); got != tt.want {
+			t.Errorf("apdexZone(%v, %v, failed %v) = %s, want %s", tt.d, threshold, tt.failed, apdexZones[got], apdexZones[tt.want])
+		}
+	}
+}
+
+func TestApdexScore(t *testing.T) {
+	tests := []struct {
+		name   string
+		counts [3]int64
+		want   float64
+		noData bool
+	}{
+		{name: "no responses", noData: true},
+		{name: "all satisfied", counts: [3]int64{5, 0, 0}, want: 1},
+		{name: "all tolerating", counts: [3]int64{0, 4, 0}, want: 0.5},
+		{name: "all frustrated", counts: [3]int64{0, 0, 3}, want: 0},
+		{name: "mixed", counts: [3]int64{6, 2, 2}, want: 0.7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apdex := newApdexCounters(NewDataSource(metrics.NewRegistry()), apdexDataSourceKey+"test")
+			for zone, n := range tt.counts {
+				for i := int64(0); i < n; i++ {
+					apdex.record(zone)
+				}
+			}
+
+			metricas := apdex.metricas("Apdex", "requests")
+			if len(metricas) != 1+len(apdexZones) {
+				t.Fatalf("got %d metricas, want the score and a counter per zone", len(metricas))
+			}
+			score := metricas[0]
+			if score.GetName() != "Apdex/Score" {
+				t.Errorf("score is named %s, want Apdex/Score", score.GetName())
+			}
+			got, err := score.GetValue()
+			if tt.noData {
+				if err != errNoValue {
+					t.Errorf("score = %v, %v, want errNoValue", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("score = %v, %v, want %v", got, err, tt.want)
+			}
+			for zone, m := range metricas[1:] {
+				if v, _ := m.GetValue(); v != float64(tt.counts[zone]) {
+					t.Errorf("%s = %v, want %d", m.GetName(), v, tt.counts[zone])
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPApdexRoutes(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		route     string
+		d         time.Duration
+		failed    bool
+		all       int
+		routeZone int // -1 when the route has no counters
+	}{
+		{"default threshold", 100 * ms, "GET /", 150 * ms, false, apdexTolerating, -1},
+		{"route threshold", 100 * ms, "GET /slow", 150 * ms, false, apdexSatisfied, apdexSatisfied},
+		{"route threshold without default", 0, "GET /slow", 900 * ms, false, apdexTolerating, apdexTolerating},
+		{"failed route request", 100 * ms, "GET /slow", 0, true, apdexFrustrated, apdexFrustrated},
+		{"zero route threshold uses the default", 100 * ms, "GET /off", 50 * ms, false, apdexSatisfied, -1},
+		{"no threshold", 0, "GET /", 50 * ms, false, -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := NewDataSource(metrics.NewRegistry())
+			apdex := newHTTPApdex(ds, tt.threshold, map[string]time.Duration{"GET /slow": 500 * ms, "GET /off": 0})
+			if !apdex.enabled() {
+				t.Fatal("apdex with a route threshold is disabled")
+			}
+			apdex.record(tt.route, tt.d, tt.failed)
+
+			for zone := range apdexZones {
+				want := 0.0
+				if zone == tt.all {
+					want = 1
+				}
+				if got := counterValue(t, ds, apdex.all.zoneKey(zone)); got != want {
+					t.Errorf("all %s = %v, want %v", apdexZones[zone], got, want)
+				}
+			}
+			r, ok := apdex.routes[tt.route]
+			if ok != (tt.routeZone >= 0) {
+				t.Fatalf("route %s has counters: %v", tt.route, ok)
+			}
+			if ok {
+				if got := counterValue(t, ds, r.counters.zoneKey(tt.routeZone)); got != 1 {
+					t.Errorf("route %s = %v, want 1", apdexZones[tt.routeZone], got)
+				}
+			}
+		})
+	}
+
+	var disabled *httpApdex
+	if disabled.enabled() || newHTTPApdex(NewDataSource(metrics.NewRegistry()), 0, nil).enabled() {
+		t.Error("apdex without thresholds is enabled")
+	}
+}
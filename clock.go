@@ -0,0 +1,69 @@
+package gorelic
+
+import "time"
+
+// Clock is the source of time for harvests, capture loops, timers and
+// system data refresh. Tests can use a manual clock (see package gorelictest)
+// to make them deterministic. Rates reported by go-metrics meters are always
+// computed with wall-clock time.
+type Clock interface {
+	Now() time.Time
+	// NewTimer creates a timer which fires once after d.
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer is a single-shot timer created by a Clock.
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the wall clock, used unless another Clock is configured.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) ClockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// agentClock follows Agent.Clock, so components built before the clock is
+// set still use it.
+type agentClock struct {
+	agent *Agent
+}
+
+func (c agentClock) Now() time.Time {
+	return c.agent.clock().Now()
+}
+
+func (c agentClock) NewTimer(d time.Duration) ClockTimer {
+	return c.agent.clock().NewTimer(d)
+}
+
+func (agent *Agent) clock() Clock {
+	if agent.Clock != nil {
+		return agent.Clock
+	}
+	return SystemClock
+}
+
+// sleep blocks for d according to clock.
+func sleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	<-clock.NewTimer(d).C()
+}
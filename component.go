@@ -0,0 +1,209 @@
+package gorelic
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// errNoValue is returned by metricas which have nothing to report for the
+// harvest interval, e.g. a score without requests. They are skipped.
+var errNoValue = errors.New("no value in the harvest interval")
+
+// componentData is what gets encoded into the harvest payload for a component.
+type componentData struct {
+	Name     string                 `json:"name"`
+	GUID     string                 `json:"guid"`
+	Duration int                    `json:"duration"`
+	Metrics  map[string]interface{} `json:"metrics"`
+}
+
+// component is the NewRelic component reported by the agent. Unlike the
+// plugin's default component it passes metrica errors on to the agent.
+type component struct {
+	name     string
+	guid     string
+	duration int
+	metricas []newrelic_platform_go.IMetrica
+	sources  []MetricaSource
+	onError  func(metrica newrelic_platform_go.IMetrica, err error)
+	seq      uint64
+	lk       sync.Mutex
+}
+
+func newComponent(name, guid string, onError func(newrelic_platform_go.IMetrica, error)) *component {
+	return &component{
+		name:    name,
+		guid:    guid,
+		onError: onError,
+	}
+}
+
+func (c *component) AddMetrica(metrica newrelic_platform_go.IMetrica) {
+	c.lk.Lock()
+	c.metricas = append(c.metricas, metrica)
+	c.lk.Unlock()
+}
+
+func (c *component) addSource(source MetricaSource) {
+	c.lk.Lock()
+	c.sources = append(c.sources, source)
+	c.lk.Unlock()
+}
+
+// all returns the fixed metricas followed by those of every source. It must
+// be called with c.lk held.
+func (c *component) all() []newrelic_platform_go.IMetrica {
+	if len(c.sources) == 0 {
+		return c.metricas
+	}
+
+	all := append([]newrelic_platform_go.IMetrica(nil), c.metricas...)
+	for _, source := range c.sources {
+		all = append(all, source.Metricas()...)
+	}
+	return all
+}
+
+func (c *component) SetDuration(duration int) {
+	c.lk.Lock()
+	c.duration = duration
+	c.lk.Unlock()
+}
+
+func (c *component) ClearSentData() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for _, metrica := range c.all() {
+		metrica.ClearSentData()
+	}
+}
+
+// each evaluates every metrica of enabled collectors and passes the result to
+// f. aggregate is set for AggregateMetricas only, value is its mean then.
+func (c *component) each(f func(metrica newrelic_platform_go.IMetrica, value float64,
+	aggregate *newrelic_platform_go.AggregatedMetricaValue, err error)) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	// metricas of disabled collectors are skipped, the others are unwrapped so
+	// that their optional interfaces are visible
+	var metricas []newrelic_platform_go.IMetrica
+	for _, metrica := range c.all() {
+		if toggled, ok := metrica.(toggledMetrica); ok {
+			if !toggled.enabled() {
+				continue
+			}
+			metrica = toggled.IMetrica
+		}
+		metricas = append(metricas, metrica)
+	}
+
+	// let interval metricas close their interval before any of them is read
+	c.seq++
+	for _, metrica := range metricas {
+		if starter, ok := metrica.(harvestStarter); ok {
+			starter.startHarvest(c.seq)
+		}
+	}
+
+	for _, metrica := range metricas {
+		var value float64
+		var aggregate *newrelic_platform_go.AggregatedMetricaValue
+		var err error
+		if am, ok := metrica.(AggregateMetrica); ok {
+			if aggregate, err = am.GetAggregateValue(); err == nil {
+				sanitizeAggregate(aggregate)
+				value = aggregateMean(aggregate)
+			}
+		} else {
+			value, err = metrica.GetValue()
+		}
+		if err == errCollectorDisabled || err == errNoValue {
+			continue
+		}
+		if err == nil && !finite(value) {
+			value = 0
+		}
+		f(metrica, value, aggregate, err)
+	}
+}
+
+func finite(f float64) bool {
+	return !math.IsInf(f, 0) && !math.IsNaN(f)
+}
+
+// sanitizeAggregate zeroes an aggregate with values NewRelic can not accept.
+func sanitizeAggregate(value *newrelic_platform_go.AggregatedMetricaValue) {
+	if !finite(value.Min) || !finite(value.Max) || !finite(value.Total) || !finite(value.SumOfSquares) {
+		*value = newrelic_platform_go.AggregatedMetricaValue{}
+	}
+}
+
+// snapshot evaluates every metrica of enabled collectors.
+func (c *component) snapshot() []SnapshotMetric {
+	var metrics []SnapshotMetric
+	c.each(func(metrica newrelic_platform_go.IMetrica, value float64,
+		aggregate *newrelic_platform_go.AggregatedMetricaValue, err error) {
+		metrics = append(metrics, SnapshotMetric{
+			Name:      metrica.GetName(),
+			Units:     metrica.GetUnits(),
+			Value:     value,
+			Aggregate: aggregate,
+			Err:       err,
+		})
+	})
+	return metrics
+}
+
+// Harvest evaluates every metrica. Metricas reported under the same key are
+// combined into a single aggregated value. Empty aggregates are not sent.
+func (c *component) Harvest(plugin newrelic_platform_go.INewrelicPlugin) newrelic_platform_go.ComponentData {
+	c.lk.Lock()
+	data := componentData{
+		Name:     c.name,
+		GUID:     c.guid,
+		Duration: c.duration,
+		Metrics:  make(map[string]interface{}, len(c.metricas)),
+	}
+	c.lk.Unlock()
+
+	c.each(func(metrica newrelic_platform_go.IMetrica, value float64,
+		aggregate *newrelic_platform_go.AggregatedMetricaValue, err error) {
+		if err != nil {
+			if c.onError != nil {
+				c.onError(metrica, err)
+			}
+			return
+		}
+
+		key := plugin.GetMetricaKey(metrica)
+		if aggregate != nil {
+			if aggregate.Count == 0 {
+				return
+			}
+			switch existing := data.Metrics[key].(type) {
+			case nil:
+				data.Metrics[key] = aggregate
+			case float64:
+				aggregate.Aggregate(existing)
+				data.Metrics[key] = aggregate
+			case *newrelic_platform_go.AggregatedMetricaValue:
+				mergeAggregates(existing, aggregate)
+			}
+			return
+		}
+
+		switch existing := data.Metrics[key].(type) {
+		case nil:
+			data.Metrics[key] = value
+		case float64:
+			data.Metrics[key] = newrelic_platform_go.NewAggregatedMetricaValue(existing, value)
+		case *newrelic_platform_go.AggregatedMetricaValue:
+			existing.Aggregate(value)
+		}
+	})
+	return data
+}
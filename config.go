@@ -0,0 +1,317 @@
+package gorelic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigFileEnv - environment variable holding the path of a config file
+// which NewAgentFromEnv reads before looking at the other variables.
+const ConfigFileEnv = "GORELIC_CONFIG_FILE"
+
+// configSetting describes a single agent setting which can be read from
+// a config file (by key) or from the environment (by env).
+type configSetting struct {
+	key   string
+	env   string
+	apply func(agent *Agent, raw string) error
+}
+
+var configSettings = []configSetting{
+	{"license", "GORELIC_LICENSE", func(agent *Agent, raw string) error {
+		if raw == "" {
+			return errors.New("must not be empty")
+		}
+		agent.NewrelicLicense = raw
+		return nil
+	}},
+	{"name", "GORELIC_NAME", func(agent *Agent, raw string) error {
+		if raw == "" {
+			return errors.New("must not be empty")
+		}
+		agent.NewrelicName = raw
+		return nil
+	}},
+	{"poll_interval", "GORELIC_POLL_INTERVAL", intSetting(1, func(agent *Agent, v int) { agent.NewrelicPollInterval = v })},
+	{"fatal_threshold", "GORELIC_FATAL_THRESHOLD", intSetting(0, func(agent *Agent, v int) { agent.NewRelicFatalThreshold = v })},
+	{"gc_poll_interval", "GORELIC_GC_POLL_INTERVAL", intSetting(1, func(agent *Agent, v int) { agent.GCPollInterval = v })},
+	{"memory_poll_interval", "GORELIC_MEMORY_POLL_INTERVAL", intSetting(1, func(agent *Agent, v int) { agent.MemoryAllocatorPollInterval = v })},
+	{"verbose", "GORELIC_VERBOSE", boolSetting(func(agent *Agent, v bool) { agent.Verbose = v })},
+	{"collect_gc", "GORELIC_COLLECT_GC", boolSetting(func(agent *Agent, v bool) { agent.CollectGcStat = v })},
+	{"collect_memory", "GORELIC_COLLECT_MEMORY", boolSetting(func(agent *Agent, v bool) { agent.CollectMemoryStat = v })},
+	{"collect_http", "GORELIC_COLLECT_HTTP", boolSetting(func(agent *Agent, v bool) { agent.CollectHTTPStat = v })},
+	{"collect_http_statuses", "GORELIC_COLLECT_HTTP_STATUSES", boolSetting(func(agent *Agent, v bool) { agent.CollectHTTPStatuses = v })},
+	{"collect_http_bytes", "GORELIC_COLLECT_HTTP_BYTES", boolSetting(func(agent *Agent, v bool) { agent.CollectHTTPBytes = v })},
+	{"collect_http_methods", "GORELIC_COLLECT_HTTP_METHODS", boolSetting(func(agent *Agent, v bool) { agent.CollectHTTPMethods = v })},
+}
+
+func intSetting(min int, set func(*Agent, int)) func(*Agent, string) error {
+	return func(agent *Agent, raw string) error {
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		if v < min {
+			return fmt.Errorf("%d is less than %d", v, min)
+		}
+		set(agent, v)
+		return nil
+	}
+}
+
+func boolSetting(set func(*Agent, bool)) func(*Agent, string) error {
+	return func(agent *Agent, raw string) error {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		set(agent, v)
+		return nil
+	}
+}
+
+func findConfigSetting(key string) *configSetting {
+	for i := range configSettings {
+		if configSettings[i].key == key {
+			return &configSettings[i]
+		}
+	}
+	return nil
+}
+
+type configValue struct {
+	raw    string
+	source string
+}
+
+// Config - agent settings collected from a config file and/or the environment.
+// Values loaded later take precedence over values loaded earlier, so the usual
+// order is: defaults from NewAgent, then LoadConfig, then LoadEnv.
+type Config struct {
+	values   map[string]configValue
+	warnings []string
+}
+
+// NewConfig builds an empty Config. Applying it leaves agent defaults untouched.
+func NewConfig() *Config {
+	return &Config{values: make(map[string]configValue)}
+}
+
+// LoadConfig reads agent settings from a JSON, YAML or TOML file. The format
+// is chosen by file extension. Only flat key/value documents are supported,
+// e.g. "poll_interval: 30" or "collect_gc = false".
+func LoadConfig(path string) (*Config, error) {
+	cfg := NewConfig()
+	if err := cfg.LoadFile(path); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile merges settings from a config file into cfg, overriding values
+// loaded before.
+func (cfg *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	default:
+		return fmt.Errorf("unsupported config file format: %s", path)
+	case ".json":
+		values, err = parseJSONConfig(data)
+	case ".yaml", ".yml":
+		values, err = parseFlatConfig(data, ":")
+	case ".toml":
+		values, err = parseFlatConfig(data, "=")
+	}
+	if err != nil {
+		return fmt.Errorf("can not parse config file %s: %v", path, err)
+	}
+
+	for key, raw := range values {
+		key = normalizeConfigKey(key)
+		if findConfigSetting(key) == nil {
+			cfg.warnings = append(cfg.warnings, fmt.Sprintf("unknown setting %q in %s", key, path))
+			continue
+		}
+		cfg.values[key] = configValue{raw, "file:" + path}
+	}
+	return nil
+}
+
+// LoadEnv merges settings from GORELIC_* environment variables into cfg,
+// overriding values loaded before.
+func (cfg *Config) LoadEnv() {
+	for _, s := range configSettings {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			cfg.values[s.key] = configValue{strings.TrimSpace(raw), "env:" + s.env}
+		}
+	}
+}
+
+// Apply copies all valid settings to the agent. Invalid values are skipped
+// and listed in the returned report, so the agent keeps its previous value.
+func (cfg *Config) Apply(agent *Agent) *ConfigReport {
+	report := &ConfigReport{
+		Sources:  make(map[string]string, len(configSettings)),
+		Warnings: append([]string(nil), cfg.warnings...),
+	}
+
+	for _, s := range configSettings {
+		v, ok := cfg.values[s.key]
+		if !ok {
+			report.Sources[s.key] = "default"
+			continue
+		}
+
+		if err := s.apply(agent, v.raw); err != nil {
+			report.Errors = append(report.Errors, fmt.Errorf("%s (%s): %v", s.key, v.source, err))
+			report.Sources[s.key] = "default"
+			continue
+		}
+		report.Sources[s.key] = v.source
+	}
+
+	if agent.NewrelicLicense == "" {
+		report.Errors = append(report.Errors, errors.New("license is not set"))
+	}
+	return report
+}
+
+// ConfigReport - result of applying a Config to an agent.
+type ConfigReport struct {
+	// Sources maps every setting key to where its value came from:
+	// "default", "file:<path>" or "env:<variable>".
+	Sources  map[string]string
+	Warnings []string
+	Errors   []error
+}
+
+// Err returns nil if the configuration is valid, or an error describing
+// every problem found.
+func (report *ConfigReport) Err() error {
+	return errors.Join(report.Errors...)
+}
+
+func (report *ConfigReport) String() string {
+	var buf bytes.Buffer
+	keys := make([]string, 0, len(report.Sources))
+	for key := range report.Sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s: %s\n", key, report.Sources[key])
+	}
+	for _, w := range report.Warnings {
+		fmt.Fprintf(&buf, "warning: %s\n", w)
+	}
+	for _, err := range report.Errors {
+		fmt.Fprintf(&buf, "error: %v\n", err)
+	}
+	return buf.String()
+}
+
+// NewAgentFromEnv builds new Agent object configured from the environment.
+// If GORELIC_CONFIG_FILE is set, that file is read first and GORELIC_*
+// variables override its values. Check report.Err() before calling Run.
+func NewAgentFromEnv() (*Agent, *ConfigReport) {
+	cfg := NewConfig()
+
+	var fileErr error
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		fileErr = cfg.LoadFile(path)
+	}
+	cfg.LoadEnv()
+
+	agent := NewAgent()
+	report := cfg.Apply(agent)
+	if fileErr != nil {
+		report.Errors = append([]error{fileErr}, report.Errors...)
+	}
+	return agent, report
+}
+
+func normalizeConfigKey(key string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(key)), "-", "_", -1)
+}
+
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(doc))
+	for key, v := range doc {
+		switch v := v.(type) {
+		default:
+			return nil, fmt.Errorf("setting %q must be a string, number or boolean", key)
+		case string:
+			values[key] = v
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		}
+	}
+	return values, nil
+}
+
+// parseFlatConfig parses the flat subset of YAML ("key: value") and TOML
+// ("key = value") used by agent config files.
+func parseFlatConfig(data []byte, sep string) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, sep, 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key%svalue", lineNo, sep)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		values[key] = unquoteConfigValue(stripConfigComment(strings.TrimSpace(parts[1])))
+	}
+	return values, scanner.Err()
+}
+
+// stripConfigComment removes a trailing comment from a value. A value is
+// quoted only if it starts with a quote, which then ends at the matching
+// quote; elsewhere quotes are plain characters, like in "it's".
+func stripConfigComment(v string) string {
+	if len(v) > 0 && (v[0] == '"' || v[0] == '\'') {
+		if end := strings.IndexByte(v[1:], v[0]); end >= 0 {
+			return v[:end+2]
+		}
+		return v
+	}
+	if i := strings.IndexByte(v, '#'); i >= 0 {
+		return strings.TrimSpace(v[:i])
+	}
+	return v
+}
+
+func unquoteConfigValue(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
@@ -0,0 +1,192 @@
+package gorelic
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	want := map[string]string{"license": "abc", "name": "api", "poll_interval": "30", "collect_gc": "false"}
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"agent.json", `{"license": "abc", "name": "api", "poll_interval": 30, "collect_gc": false}`},
+		{"agent.yaml", "---\n# agent settings\nlicense: abc\nname: \"api\"\npoll-interval: 30 # seconds\ncollect_gc: false\n"},
+		{"agent.yml", "license: 'abc'\nname: api\npoll_interval: 30\nCollect_GC: false\n"},
+		{"agent.toml", "license = \"abc\" # secret\nname = 'api'\n\npoll_interval = 30\ncollect_gc = false\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadConfig(writeConfigFile(t, tt.name, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string, len(cfg.values))
+			for key, v := range cfg.values {
+				got[key] = v.raw
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"agent.ini", "license=abc", "unsupported config file format"},
+		{"agent.json", `{"license": ["abc"]}`, "must be a string, number or boolean"},
+		{"agent.json", `{"license": `, "can not parse"},
+		{"agent.yaml", "license abc", "line 1: expected key:value"},
+		{"agent.toml", "# comment\nlicense: abc", "line 2: expected key=value"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfig(writeConfigFile(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: got error %v, want %q", tt.name, tt.content, err, tt.err)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got error %v", err)
+	}
+}
+
+func TestStripConfigComment(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"abc", "abc"},
+		{"abc # comment", "abc"},
+		{"it's mine # prod", "it's mine"},
+		{"it's a 'b' # c", "it's a 'b'"},
+		{`"a # b" # comment`, `"a # b"`},
+		{`'it"s # here' # c`, `'it"s # here'`},
+		{`"unterminated # x`, `"unterminated # x`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := stripConfigComment(tt.value); got != tt.want {
+			t.Errorf("stripConfigComment(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "agent.yaml", "license: file\nname: file\npoll_interval: 30\n")
+	t.Setenv("GORELIC_NAME", " env ")
+	t.Setenv("GORELIC_POLL_INTERVAL", "")
+	t.Setenv(ConfigFileEnv, path)
+
+	agent, report := NewAgentFromEnv()
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0].Error(), "poll_interval (env:GORELIC_POLL_INTERVAL)") {
+		t.Errorf("errors = %v, want only the empty env poll interval", report.Errors)
+	}
+	if agent.NewrelicLicense != "file" || agent.NewrelicName != "env" || agent.NewrelicPollInterval != DefaultNewRelicPollInterval {
+		t.Errorf("license %q, name %q, poll interval %d", agent.NewrelicLicense, agent.NewrelicName, agent.NewrelicPollInterval)
+	}
+	for key, want := range map[string]string{
+		"license":       "file:" + path,
+		"name":          "env:GORELIC_NAME",
+		"poll_interval": "default",
+		"verbose":       "default",
+	} {
+		if got := report.Sources[key]; got != want {
+			t.Errorf("source of %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	tests := []struct {
+		setting string
+		raw     string
+		err     string
+	}{
+		{"license", "", "license (test): must not be empty"},
+		{"name", "", "name (test): must not be empty"},
+		{"poll_interval", "0", "poll_interval (test): 0 is less than 1"},
+		{"poll_interval", "1m", `poll_interval (test): "1m" is not an integer`},
+		{"fatal_threshold", "-1", "fatal_threshold (test): -1 is less than 0"},
+		{"fatal_threshold", "0", ""},
+		{"collect_gc", "yes", `collect_gc (test): "yes" is not a boolean`},
+		{"collect_gc", "0", ""},
+	}
+	for _, tt := range tests {
+		cfg := NewConfig()
+		cfg.values["license"] = configValue{"abc", "test"}
+		cfg.values[tt.setting] = configValue{tt.raw, "test"}
+		agent := NewAgent()
+		report := cfg.Apply(agent)
+
+		var errs []string
+		for _, err := range report.Errors {
+			errs = append(errs, err.Error())
+		}
+		switch {
+		case tt.err == "" && report.Err() != nil:
+			t.Errorf("%s=%q: unexpected errors %v", tt.setting, tt.raw, errs)
+		case tt.err != "" && !strings.Contains(strings.Join(errs, "\n"), tt.err):
+			t.Errorf("%s=%q: got errors %v, want %q", tt.setting, tt.raw, errs, tt.err)
+		case tt.err != "" && report.Sources[tt.setting] != "default":
+			t.Errorf("%s=%q: source of an invalid value is %q, want default", tt.setting, tt.raw, report.Sources[tt.setting])
+		}
+	}
+
+	// invalid values keep the previous setting
+	agent := NewAgent()
+	cfg := NewConfig()
+	cfg.values["poll_interval"] = configValue{"-5", "test"}
+	report := cfg.Apply(agent)
+	if agent.NewrelicPollInterval != DefaultNewRelicPollInterval {
+		t.Errorf("poll interval = %d after an invalid value", agent.NewrelicPollInterval)
+	}
+	if len(report.Errors) != 2 || report.Errors[1].Error() != "license is not set" {
+		t.Errorf("errors = %v, want the poll interval and the missing license", report.Errors)
+	}
+}
+
+func TestConfigReport(t *testing.T) {
+	cfg, err := LoadConfig(writeConfigFile(t, "agent.toml", "license = \"abc\"\npoll_interval = \"x\"\ncolor = \"red\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := cfg.Apply(NewAgent())
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], `unknown setting "color"`) {
+		t.Errorf("warnings = %v", report.Warnings)
+	}
+	if len(report.Sources) != len(configSettings) {
+		t.Errorf("got sources of %d settings, want %d", len(report.Sources), len(configSettings))
+	}
+	if report.Err() == nil {
+		t.Error("Err() = nil with an invalid poll interval")
+	}
+
+	s := report.String()
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if len(lines) != len(configSettings)+2 {
+		t.Fatalf("report has %d lines:\n%s", len(lines), s)
+	}
+	if !strings.HasPrefix(lines[0], "collect_gc: default") {
+		t.Errorf("sources are not sorted:\n%s", s)
+	}
+	if !strings.HasPrefix(lines[len(lines)-2], "warning: ") || !strings.HasPrefix(lines[len(lines)-1], "error: poll_interval") {
+		t.Errorf("warnings and errors do not come last:\n%s", s)
+	}
+}
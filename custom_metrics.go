@@ -0,0 +1,169 @@
+package gorelic
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/newrelic_platform_go"
+)
+
+const customDataSourceKey = "gorelic.custom." // add path to the end
+
+// MetricOption configures a single metric created by the agent.
+type MetricOption func(*metricOptions)
+
+type metricOptions struct {
+	timerStats     TimerStats
+	histogramStats HistogramStats
+	percentiles    []float64
+	reservoir      Reservoir
+}
+
+// WithTimerStats sets the statistics reported for a timer instead of
+// Agent.TimerStats.
+func WithTimerStats(stats TimerStats) MetricOption {
+	return func(o *metricOptions) { o.timerStats = stats }
+}
+
+// WithHistogramStats sets the statistics reported for a histogram instead of
+// Agent.HistogramStats.
+func WithHistogramStats(stats HistogramStats) MetricOption {
+	return func(o *metricOptions) { o.histogramStats = stats }
+}
+
+// WithPercentiles replaces the percentiles reported for a timer or histogram,
+// e.g. WithPercentiles(0.5, 0.9, 0.99, 0.999).
+func WithPercentiles(percentiles ...float64) MetricOption {
+	return func(o *metricOptions) { o.percentiles = percentiles }
+}
+
+// WithReservoir sets the sample of a timer or histogram instead of
+// Agent.Reservoir.
+func WithReservoir(r Reservoir) MetricOption {
+	return func(o *metricOptions) { o.reservoir = r }
+}
+
+func (agent *Agent) metricOptions(opts []MetricOption) metricOptions {
+	o := metricOptions{
+		timerStats:     agent.TimerStats,
+		histogramStats: agent.HistogramStats,
+		reservoir:      agent.Reservoir,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.percentiles != nil {
+		o.timerStats.Percentiles = o.percentiles
+		o.histogramStats.Percentiles = o.percentiles
+	}
+	return o
+}
+
+// registerCustom registers the metric built by newMetric under path in the
+// agent data source and, the first time path is used, adds the metricas built
+// by newMetricas. It returns the metric registered under path.
+func (agent *Agent) registerCustom(path string, newMetric func() interface{},
+	newMetricas func(ds DataSource, dataSourceKey, basePath string) []newrelic_platform_go.IMetrica) interface{} {
+	path = strings.Trim(path, "/")
+	key := customDataSourceKey + path
+
+	if m := agent.dataSource.Get(key); m != nil {
+		return m
+	}
+	m := newMetric()
+	if err := agent.dataSource.Register(key, m); err != nil {
+		return agent.dataSource.Get(key)
+	}
+
+	for _, metrica := range newMetricas(agent.dataSource, key, path) {
+		agent.AddCustomMetric(metrica)
+	}
+	return m
+}
+
+// customTypeMismatch logs that path is registered as m and can not be used as
+// a want. The caller gets a no-op metric instead.
+func (agent *Agent) customTypeMismatch(path, want string, m interface{}) {
+	agent.logger().Warn("custom metric path is registered as another type", "path", strings.Trim(path, "/"),
+		"want", want, "registered", fmt.Sprintf("%T", m))
+}
+
+// NewTimer creates a timer reported under path with rates (Rate1, Rate5,
+// Rate15, RateMean) and the statistics of Agent.TimerStats, unless opts say
+// otherwise. Calling it again with the same path returns the same timer.
+// If path is already used by another type of metric, a warning is logged and
+// a timer that records nothing is returned.
+func (agent *Agent) NewTimer(path string, opts ...MetricOption) metrics.Timer {
+	o := agent.metricOptions(opts)
+	m := agent.registerCustom(path, func() interface{} { return agent.newTimer(o.reservoir) },
+		func(ds DataSource, key, basePath string) []newrelic_platform_go.IMetrica {
+			return append(GetTimerMeterMetrica(ds, key, basePath, "calls"), o.timerStats.Metricas(ds, key, basePath, "calls")...)
+		})
+	timer, ok := m.(metrics.Timer)
+	if !ok {
+		agent.customTypeMismatch(path, "timer", m)
+		return metrics.NilTimer{}
+	}
+	return timer
+}
+
+// NewCounter creates a counter reported under path. The counter is reset
+// after every successful harvest, so NewRelic gets counts per interval.
+func (agent *Agent) NewCounter(path, units string) metrics.Counter {
+	m := agent.registerCustom(path, newCounter,
+		func(ds DataSource, key, basePath string) []newrelic_platform_go.IMetrica {
+			return []newrelic_platform_go.IMetrica{NewCounterMetrica(ds, key, basePath, units)}
+		})
+	counter, ok := m.(metrics.Counter)
+	if !ok {
+		agent.customTypeMismatch(path, "counter", m)
+		return metrics.NilCounter{}
+	}
+	return counter
+}
+
+// NewGauge creates a gauge reported under path.
+func (agent *Agent) NewGauge(path, units string) metrics.Gauge {
+	m := agent.registerCustom(path, newGauge,
+		func(ds DataSource, key, basePath string) []newrelic_platform_go.IMetrica {
+			return []newrelic_platform_go.IMetrica{NewGaugeMetrica(ds, key, basePath, units)}
+		})
+	gauge, ok := m.(metrics.Gauge)
+	if !ok {
+		agent.customTypeMismatch(path, "gauge", m)
+		return metrics.NilGauge{}
+	}
+	return gauge
+}
+
+// NewHistogram creates a histogram reported under path with the statistics
+// of Agent.HistogramStats, unless opts say otherwise.
+func (agent *Agent) NewHistogram(path, units string, opts ...MetricOption) metrics.Histogram {
+	o := agent.metricOptions(opts)
+	m := agent.registerCustom(path, func() interface{} { return newHistogram(agent.newSample(o.reservoir)) },
+		func(ds DataSource, key, basePath string) []newrelic_platform_go.IMetrica {
+			return o.histogramStats.Metricas(ds, key, basePath, units)
+		})
+	histogram, ok := m.(metrics.Histogram)
+	if !ok {
+		agent.customTypeMismatch(path, "histogram", m)
+		return metrics.NilHistogram{}
+	}
+	return histogram
+}
+
+// NewMeter creates a meter reported under path with Rate1, Rate5, Rate15 and
+// RateMean metrics.
+func (agent *Agent) NewMeter(path, units string) metrics.Meter {
+	m := agent.registerCustom(path, newMeter,
+		func(ds DataSource, key, basePath string) []newrelic_platform_go.IMetrica {
+			return GetMeterMetrica(ds, key, basePath, units)
+		})
+	meter, ok := m.(metrics.Meter)
+	if !ok {
+		agent.customTypeMismatch(path, "meter", m)
+		return metrics.NilMeter{}
+	}
+	return meter
+}
@@ -0,0 +1,48 @@
+package gorelic
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestNewMetricSamePath(t *testing.T) {
+	agent := NewAgent()
+	c := agent.NewCounter("Jobs", "jobs")
+	if agent.NewCounter("/Jobs/", "jobs") != c {
+		t.Error("NewCounter returned another counter for the same path")
+	}
+	if n := len(agent.CustomMetrics); n != 1 {
+		t.Errorf("got %d custom metricas, want 1", n)
+	}
+}
+
+func TestNewMetricTypeMismatch(t *testing.T) {
+	var log bytes.Buffer
+	agent := NewAgent()
+	agent.Logger = slog.New(slog.NewTextHandler(&log, nil))
+
+	agent.NewCounter("X", "calls")
+	if _, ok := agent.NewTimer("X").(metrics.NilTimer); !ok {
+		t.Error("NewTimer on a counter path did not return a NilTimer")
+	}
+	if _, ok := agent.NewGauge("X", "calls").(metrics.NilGauge); !ok {
+		t.Error("NewGauge on a counter path did not return a NilGauge")
+	}
+	if _, ok := agent.NewHistogram("X", "calls").(metrics.NilHistogram); !ok {
+		t.Error("NewHistogram on a counter path did not return a NilHistogram")
+	}
+	if _, ok := agent.NewMeter("X", "calls").(metrics.NilMeter); !ok {
+		t.Error("NewMeter on a counter path did not return a NilMeter")
+	}
+	agent.NewTimer("T")
+	if _, ok := agent.NewCounter("T", "calls").(metrics.NilCounter); !ok {
+		t.Error("NewCounter on a timer path did not return a NilCounter")
+	}
+	if n := strings.Count(log.String(), "registered as another type"); n != 5 {
+		t.Errorf("got %d warnings, want 5:\n%s", n, log.String())
+	}
+}
@@ -31,6 +31,9 @@ const (
 	MeterRateMean
 )
 
+// Timer durations (Max, Mean, Min, percentiles, StdDev and Sum) are returned
+// in milliseconds and Variance in ms². StdDev, Sum and Variance used to be
+// returned in nanoseconds (ns²).
 const (
 	TimerCount TimerFunc = iota
 	TimerMax
@@ -63,12 +66,125 @@ type DataSource interface {
 	TimerFuncForKey(key string, f func())
 }
 
+// ClockSource is implemented by data sources which measure timer durations
+// with a Clock, like those built by NewDataSourceWithClock.
+type ClockSource interface {
+	Clock() Clock
+}
+
+// clockOf returns the clock of ds, or SystemClock if it has none.
+func clockOf(ds DataSource) Clock {
+	if cs, ok := ds.(ClockSource); ok {
+		return cs.Clock()
+	}
+	return SystemClock
+}
+
+// LabeledDataSource is a DataSource which keeps a series per label set. Data
+// sources built by NewDataSource and its variants implement it.
+type LabeledDataSource interface {
+	DataSource
+
+	// Label-aware updates. The series for key and labels is created on first
+	// use; with no labels the metric is registered under key itself.
+	IncCounter(key string, i int64, labels ...Label)
+	UpdateGauge(key string, i int64, labels ...Label)
+	UpdateHistogram(key string, i int64, labels ...Label)
+	MarkMeter(key string, i int64, labels ...Label)
+	UpdateTimer(key string, d time.Duration, labels ...Label)
+	UpdateTimerSince(key string, t time.Time, labels ...Label)
+	Time(key string, f func(), labels ...Label)
+	// Series lists the label sets created for key, e.g. for backends which
+	// support dimensions.
+	Series(key string) []Series
+	// SetCardinalityLimit overrides DefaultCardinalityLimit for key.
+	SetCardinalityLimit(key string, limit int)
+}
+
 type dataSource struct {
 	metrics.Registry
+	clock     Clock
+	index     *seriesIndex
+	strict    *strictMode
+	newSample func() metrics.Sample
+}
+
+// DataSourceErrorsKey - data source key of the counter of errors found in strict mode.
+const DataSourceErrorsKey = "gorelic.datasource.errors"
+
+// DataSourceOptions configure a DataSource built by NewDataSourceWithOptions.
+type DataSourceOptions struct {
+	// Clock measures timer durations. Defaults to SystemClock.
+	Clock Clock
+	// Strict makes updates which would otherwise be silently dropped, because
+	// the key is not registered (*ForKey methods) or holds a metric of another
+	// type, count in the DataSourceErrorsKey counter and call OnError.
+	Strict  bool
+	OnError func(err *MetricError)
+	// NewSample creates the samples of histograms and timers registered on
+	// first use, see NewSample. Defaults to the exp-decay sample of go-metrics.
+	NewSample func() metrics.Sample
+}
+
+// MetricError describes an update dropped by a strict DataSource.
+type MetricError struct {
+	Key string
+	// Want is the metric type the update was for, e.g. "counter".
+	Want string
+	// Got is the registered metric, or nil if the key is not registered.
+	Got interface{}
+}
+
+func (err *MetricError) Error() string {
+	if err.Got == nil {
+		return fmt.Sprintf("metric %s is not registered", err.Key)
+	}
+	return fmt.Sprintf("metric %s is %T, not a %s", err.Key, err.Got, err.Want)
+}
+
+type strictMode struct {
+	errors  metrics.Counter
+	onError func(err *MetricError)
+}
+
+func NewDataSource(r metrics.Registry) LabeledDataSource {
+	return NewDataSourceWithOptions(r, DataSourceOptions{})
 }
 
-func NewDataSource(r metrics.Registry) DataSource {
-	return dataSource{r}
+// NewDataSourceWithClock builds a DataSource whose timers measure durations with clock.
+func NewDataSourceWithClock(r metrics.Registry, clock Clock) LabeledDataSource {
+	return NewDataSourceWithOptions(r, DataSourceOptions{Clock: clock})
+}
+
+// NewDataSourceWithOptions builds a DataSource configured by opts.
+func NewDataSourceWithOptions(r metrics.Registry, opts DataSourceOptions) LabeledDataSource {
+	ds := dataSource{Registry: r, clock: opts.Clock, index: newSeriesIndex(), newSample: opts.NewSample}
+	if ds.clock == nil {
+		ds.clock = SystemClock
+	}
+
+	if opts.Strict {
+		ds.strict = &strictMode{metrics.NewCounter(), opts.OnError}
+		r.Register(DataSourceErrorsKey, ds.strict.errors)
+	}
+	return ds
+}
+
+// mismatch reports, in strict mode, an update of key dropped because the key
+// holds got instead of a metric of type want.
+func (ds dataSource) mismatch(key, want string, got interface{}) {
+	if ds.strict == nil {
+		return
+	}
+
+	ds.strict.errors.Inc(1)
+	if ds.strict.onError != nil {
+		ds.strict.onError(&MetricError{key, want, got})
+	}
+}
+
+func (ds dataSource) Clock() Clock {
+	return ds.clock
 }
 
 func (ds dataSource) GetCounterValue(key string) (float64, error) {
@@ -169,11 +285,11 @@ func (ds dataSource) GetTimerValue(key string, tf TimerFunc, percentile float64)
 		case TimerRateMean:
 			return float64(timer.RateMean()), nil
 		case TimerStdDev:
-			return float64(timer.StdDev()), nil
+			return float64(timer.StdDev()) / float64(time.Millisecond), nil
 		case TimerSum:
-			return float64(timer.Sum()), nil
+			return float64(timer.Sum()) / float64(time.Millisecond), nil
 		case TimerVariance:
-			return float64(timer.Variance()), nil
+			return timer.Variance() / float64(time.Millisecond*time.Millisecond), nil
 		}
 	} else {
 		return 0, fmt.Errorf("metrica container has unexpected type: %T\n", valueContainer)
@@ -183,50 +299,70 @@ func (ds dataSource) GetTimerValue(key string, tf TimerFunc, percentile float64)
 func (ds dataSource) gaugeForKey(key string) (gauge metrics.Gauge) {
 	var container interface{}
 	if container = ds.Get(key); container == nil {
+		ds.mismatch(key, "gauge", nil)
 		return
 	}
 
-	gauge, _ = container.(metrics.Gauge)
+	var ok bool
+	if gauge, ok = container.(metrics.Gauge); !ok {
+		ds.mismatch(key, "gauge", container)
+	}
 	return
 }
 
 func (ds dataSource) counterForKey(key string) (counter metrics.Counter) {
 	var container interface{}
 	if container = ds.Get(key); container == nil {
+		ds.mismatch(key, "counter", nil)
 		return
 	}
 
-	counter, _ = container.(metrics.Counter)
+	var ok bool
+	if counter, ok = container.(metrics.Counter); !ok {
+		ds.mismatch(key, "counter", container)
+	}
 	return
 }
 
 func (ds dataSource) histogramForKey(key string) (histogram metrics.Histogram) {
 	var container interface{}
 	if container = ds.Get(key); container == nil {
+		ds.mismatch(key, "histogram", nil)
 		return
 	}
 
-	histogram, _ = container.(metrics.Histogram)
+	var ok bool
+	if histogram, ok = container.(metrics.Histogram); !ok {
+		ds.mismatch(key, "histogram", container)
+	}
 	return
 }
 
 func (ds dataSource) meterForKey(key string) (meter metrics.Meter) {
 	var container interface{}
 	if container = ds.Get(key); container == nil {
+		ds.mismatch(key, "meter", nil)
 		return
 	}
 
-	meter, _ = container.(metrics.Meter)
+	var ok bool
+	if meter, ok = container.(metrics.Meter); !ok {
+		ds.mismatch(key, "meter", container)
+	}
 	return
 }
 
 func (ds dataSource) timerForKey(key string) (timer metrics.Timer) {
 	var container interface{}
 	if container = ds.Get(key); container == nil {
+		ds.mismatch(key, "timer", nil)
 		return
 	}
 
-	timer, _ = container.(metrics.Timer)
+	var ok bool
+	if timer, ok = container.(metrics.Timer); !ok {
+		ds.mismatch(key, "timer", container)
+	}
 	return
 }
 
@@ -262,12 +398,16 @@ func (ds dataSource) UpdateTimerForKey(key string, d time.Duration) {
 
 func (ds dataSource) UpdateTimerSinceForKey(key string, t time.Time) {
 	if timer := ds.timerForKey(key); timer != nil {
-		timer.UpdateSince(t)
+		timer.Update(ds.clock.Now().Sub(t))
 	}
 }
 
 func (ds dataSource) TimerFuncForKey(key string, f func()) {
 	if timer := ds.timerForKey(key); timer != nil {
-		timer.Time(f)
+		startTime := ds.clock.Now()
+		f()
+		timer.Update(ds.clock.Now().Sub(startTime))
+	} else {
+		f()
 	}
 }
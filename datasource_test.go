@@ -0,0 +1,68 @@
+package gorelic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+// plainDataSource has only the methods of DataSource, like implementations
+// outside this package.
+type plainDataSource struct {
+	DataSource
+}
+
+type fixedClock struct {
+	Clock
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time { return c.now }
+
+func TestClockOf(t *testing.T) {
+	now := time.Unix(100, 0)
+	ds := NewDataSourceWithClock(metrics.NewRegistry(), fixedClock{SystemClock, now})
+	if got := clockOf(ds).Now(); !got.Equal(now) {
+		t.Errorf("clockOf(NewDataSourceWithClock(...)).Now() = %v, want %v", got, now)
+	}
+	if got := clockOf(plainDataSource{ds}); got != SystemClock {
+		t.Errorf("clockOf(data source without Clock) = %v, want SystemClock", got)
+	}
+}
+
+func TestPlainDataSourceMetricas(t *testing.T) {
+	ds := plainDataSource{NewDataSource(metrics.NewRegistry())}
+	ds.Register("c", metrics.NewCounter())
+	ds.IncCounterForKey("c", 3)
+	if value, err := NewCounterMetrica(ds, "c", "C", "calls").GetValue(); err != nil || value != 3 {
+		t.Errorf("GetValue() = %v, %v, want 3", value, err)
+	}
+
+	ds.Register("t", metrics.NewTimer())
+	ds.UpdateTimerForKey("t", 5*time.Millisecond)
+	if value, err := NewTimerMetrica(ds, "t", "T", "ms", TimerMax).GetValue(); err != nil || value != 5 {
+		t.Errorf("GetValue() = %v, %v, want 5", value, err)
+	}
+}
+
+func TestGetTimerValueUnits(t *testing.T) {
+	ds := NewDataSource(metrics.NewRegistry())
+	timer := metrics.NewTimer()
+	ds.Register("t", timer)
+	timer.Update(2 * time.Millisecond)
+	timer.Update(4 * time.Millisecond)
+
+	for tf, want := range map[TimerFunc]float64{
+		TimerMax:      4,
+		TimerMean:     3,
+		TimerMin:      2,
+		TimerStdDev:   1,
+		TimerSum:      6,
+		TimerVariance: 1,
+	} {
+		if v, err := ds.GetTimerValue("t", tf, 0); err != nil || v != want {
+			t.Errorf("%s = %v, %v, want %v ms", timerFuncNames[tf], v, err, want)
+		}
+	}
+}
@@ -2,15 +2,13 @@ package gorelic
 
 import (
 	"path/filepath"
-	"time"
 
 	"github.com/courtf/go-metrics"
 	"github.com/courtf/newrelic_platform_go"
 )
 
-func addGCMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, pollInterval int) {
+func addGCMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource) {
 	metrics.RegisterDebugGCStats(ds)
-	go metrics.CaptureDebugGCStats(ds, time.Duration(pollInterval)*time.Second)
 
 	basePath := "Runtime/GC/"
 	component.AddMetrica(NewGaugeMetrica(ds, "debug.GCStats.NumGC", filepath.Join(basePath, "TotalCalls"), "calls"))
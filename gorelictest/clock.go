@@ -0,0 +1,113 @@
+package gorelictest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/courtf/gorelic"
+)
+
+// ManualClock is a gorelic.Clock which only moves when told to. Set it as
+// Agent.Clock (or pass it to gorelic.NewDataSourceWithClock) before Run and
+// call Advance to trigger harvests and capture loops.
+type ManualClock struct {
+	lk     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock builds a clock stopped at start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTimer(d time.Duration) gorelic.ClockTimer {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	t := &manualTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer due by then in
+// deadline order.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lk.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+
+	sort.Slice(c.timers, func(i, j int) bool { return c.timers[i].deadline.Before(c.timers[j].deadline) })
+	pending := c.timers[:0]
+	var due []*manualTimer
+	for _, t := range c.timers {
+		if t.deadline.After(now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.lk.Unlock()
+
+	for _, t := range due {
+		select {
+		case t.c <- now:
+		default:
+		}
+	}
+}
+
+// Timers returns the number of timers waiting to fire. Tests can poll it to
+// know that loops driven by the clock went back to sleep.
+func (c *ManualClock) Timers() int {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least n timers are waiting to fire, or
+// timeout passes in real time. It reports whether that happened.
+func (c *ManualClock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Timers() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.lk.Lock()
+	defer t.clock.lk.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
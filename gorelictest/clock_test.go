@@ -0,0 +1,113 @@
+package gorelictest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/courtf/gorelic"
+)
+
+func fired(timer gorelic.ClockTimer) (time.Time, bool) {
+	select {
+	case t := <-timer.C():
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewManualClock(start)
+	if now := c.Now(); !now.Equal(start) {
+		t.Fatalf("Now() = %v, want %v", now, start)
+	}
+
+	late := c.NewTimer(3 * time.Second)
+	early := c.NewTimer(time.Second)
+	stopped := c.NewTimer(2 * time.Second)
+	if n := c.Timers(); n != 3 {
+		t.Fatalf("Timers() = %d, want 3", n)
+	}
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("Stop should report true only for a pending timer")
+	}
+
+	if _, ok := fired(c.NewTimer(0)); !ok {
+		t.Error("a timer of zero duration did not fire at once")
+	}
+
+	c.Advance(500 * time.Millisecond)
+	if _, ok := fired(early); ok {
+		t.Error("timer fired before its deadline")
+	}
+
+	c.Advance(2 * time.Second)
+	if now, ok := fired(early); !ok || !now.Equal(start.Add(2500*time.Millisecond)) {
+		t.Errorf("early timer: fired %v at %v, want the time of Advance", ok, now)
+	}
+	if _, ok := fired(late); ok {
+		t.Error("late timer fired before its deadline")
+	}
+	if _, ok := fired(stopped); ok {
+		t.Error("stopped timer fired")
+	}
+	if n := c.Timers(); n != 1 {
+		t.Errorf("Timers() = %d, want 1", n)
+	}
+
+	c.Advance(time.Second)
+	if _, ok := fired(late); !ok {
+		t.Error("late timer did not fire")
+	}
+	if late.Stop() {
+		t.Error("Stop reported true for a fired timer")
+	}
+	if now := c.Now(); !now.Equal(start.Add(3500 * time.Millisecond)) {
+		t.Errorf("Now() = %v after advancing 3.5s", now)
+	}
+}
+
+func TestWaitForTimers(t *testing.T) {
+	c := NewManualClock(time.Unix(0, 0))
+	go c.NewTimer(time.Second)
+	if !c.WaitForTimers(1, 5*time.Second) {
+		t.Fatal("WaitForTimers did not see the timer")
+	}
+	if c.WaitForTimers(2, 10*time.Millisecond) {
+		t.Error("WaitForTimers reported a timer which was never created")
+	}
+}
+
+func TestManualClockDrivesHarvests(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	agent := newTestAgent(s)
+	clock := NewManualClock(time.Unix(0, 0))
+	agent.Clock = clock
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first harvest is sent at once, then the harvest, GC and memory
+	// loops wait for the clock
+	s.WaitForHarvest(t, 5*time.Second)
+	if !clock.WaitForTimers(3, 5*time.Second) {
+		t.Fatalf("got %d timers, want 3", clock.Timers())
+	}
+
+	clock.Advance(time.Duration(agent.NewrelicPollInterval-1) * time.Second)
+	if !clock.WaitForTimers(3, 5*time.Second) {
+		t.Fatalf("got %d timers, want 3", clock.Timers())
+	}
+	if n := len(s.Harvests()); n != 1 {
+		t.Fatalf("got %d harvests before the poll interval passed, want 1", n)
+	}
+
+	clock.Advance(time.Second)
+	h := s.WaitForHarvests(t, 2, 5*time.Second)[1]
+	if d := h.Payload.Components[0].Duration; d != agent.NewrelicPollInterval {
+		t.Errorf("harvest duration = %d, want %d", d, agent.NewrelicPollInterval)
+	}
+}
@@ -0,0 +1,286 @@
+// Package gorelictest provides an in-process fake of the NewRelic platform
+// API, so instrumentation done with gorelic can be tested without sending
+// data to NewRelic.
+package gorelictest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/courtf/gorelic"
+)
+
+// Harvest is a single request received by the fake collector.
+type Harvest struct {
+	Header  http.Header
+	Body    []byte
+	Payload Payload
+}
+
+// Payload is a decoded harvest request body.
+type Payload struct {
+	Agent struct {
+		Host    string `json:"host"`
+		Version string `json:"version"`
+		Pid     int    `json:"pid"`
+	} `json:"agent"`
+	Components []Component `json:"components"`
+}
+
+// Component is a single component of a harvest payload.
+type Component struct {
+	Name     string                 `json:"name"`
+	GUID     string                 `json:"guid"`
+	Duration int                    `json:"duration"`
+	Metrics  map[string]MetricValue `json:"metrics"`
+}
+
+// MetricValue is a reported metric, either a plain number or an aggregate.
+// For plain numbers Count is 1 and all other fields equal Value.
+type MetricValue struct {
+	// Value is the plain number, or Total/Count for aggregates.
+	Value        float64
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	Total        float64 `json:"total"`
+	Count        int     `json:"count"`
+	SumOfSquares float64 `json:"sum_of_squares"`
+}
+
+func (v *MetricValue) UnmarshalJSON(data []byte) error {
+	var f float64
+	if err := json.Unmarshal(data, &f); err == nil {
+		*v = MetricValue{Value: f, Min: f, Max: f, Total: f, Count: 1, SumOfSquares: f * f}
+		return nil
+	}
+
+	type aggregate MetricValue
+	var a aggregate
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	*v = MetricValue(a)
+	if v.Count > 0 {
+		v.Value = v.Total / float64(v.Count)
+	}
+	return nil
+}
+
+// Metric looks up a metric in the harvest. name may be the full key, like
+// "Component/HTTP/Throughput/Rate1[rps]", or just the path, like
+// "HTTP/Throughput/Rate1".
+func (h Harvest) Metric(name string) (MetricValue, bool) {
+	for _, c := range h.Payload.Components {
+		for key, v := range c.Metrics {
+			if key == name || metricPath(key) == name {
+				return v, true
+			}
+		}
+	}
+	return MetricValue{}, false
+}
+
+// metricPath strips the "Component/" prefix and the "[units]" suffix from a metric key.
+func metricPath(key string) string {
+	key = strings.TrimPrefix(key, "Component/")
+	if i := strings.LastIndex(key, "["); i >= 0 && strings.HasSuffix(key, "]") {
+		key = key[:i]
+	}
+	return key
+}
+
+// Server is a fake NewRelic platform API recording every harvest it receives.
+type Server struct {
+	*httptest.Server
+
+	lk       sync.Mutex
+	harvests []Harvest
+	failures []int
+	// received is closed and replaced whenever a harvest is recorded or handled
+	received chan struct{}
+	// hooked is set by Configure, unhandled counts requests the agent has not
+	// finished handling since
+	hooked    bool
+	unhandled int
+}
+
+// NewServer starts a fake collector. Close it when done.
+func NewServer() *Server {
+	s := &Server{received: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lk.Lock()
+	if s.hooked {
+		s.unhandled++
+	}
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		s.lk.Unlock()
+		w.WriteHeader(status)
+		return
+	}
+
+	h := Harvest{Header: req.Header.Clone(), Body: body}
+	if err := json.Unmarshal(body, &h.Payload); err != nil {
+		s.lk.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.harvests = append(s.harvests, h)
+	s.notify()
+	s.lk.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// notify wakes up WaitForHarvests. s.lk must be held.
+func (s *Server) notify() {
+	close(s.received)
+	s.received = make(chan struct{})
+}
+
+// Configure points the agent at the fake collector. It also sets
+// Agent.AfterHarvest, keeping a hook set before, so that WaitForHarvest
+// returns only once the agent has handled the response.
+func (s *Server) Configure(agent *gorelic.Agent) {
+	agent.Endpoint = s.URL
+	if agent.NewrelicLicense == "" {
+		agent.NewrelicLicense = "gorelictest"
+	}
+
+	s.lk.Lock()
+	s.hooked = true
+	s.lk.Unlock()
+	next := agent.AfterHarvest
+	agent.AfterHarvest = func(err error) {
+		if next != nil {
+			next(err)
+		}
+		s.lk.Lock()
+		s.unhandled = 0
+		s.notify()
+		s.lk.Unlock()
+	}
+}
+
+// Fail makes the next len(statuses) requests fail with the given status codes.
+// Failed requests are not recorded.
+func (s *Server) Fail(statuses ...int) {
+	s.lk.Lock()
+	s.failures = append(s.failures, statuses...)
+	s.lk.Unlock()
+}
+
+// Harvests returns all recorded harvests, oldest first.
+func (s *Server) Harvests() []Harvest {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]Harvest(nil), s.harvests...)
+}
+
+// LastHarvest returns the latest recorded harvest.
+func (s *Server) LastHarvest() (Harvest, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if len(s.harvests) == 0 {
+		return Harvest{}, false
+	}
+	return s.harvests[len(s.harvests)-1], true
+}
+
+// Metric returns the value of a metric in the latest harvest which reported it.
+func (s *Server) Metric(name string) (MetricValue, bool) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for i := len(s.harvests) - 1; i >= 0; i-- {
+		if v, ok := s.harvests[i].Metric(name); ok {
+			return v, true
+		}
+	}
+	return MetricValue{}, false
+}
+
+// WaitForHarvest waits for the next harvest to arrive and returns it. The
+// test fails if none arrives within timeout. For an agent set up with
+// Configure, it returns after the agent has handled the response, so values
+// recorded afterwards are reported by the following harvest.
+func (s *Server) WaitForHarvest(t testing.TB, timeout time.Duration) Harvest {
+	t.Helper()
+	s.lk.Lock()
+	n := len(s.harvests)
+	s.lk.Unlock()
+	return s.WaitForHarvests(t, n+1, timeout)[n]
+}
+
+// WaitForHarvests waits until at least n harvests have been recorded and
+// returns all of them, once the agent has handled them (see WaitForHarvest).
+// The test fails if that does not happen within timeout.
+func (s *Server) WaitForHarvests(t testing.TB, n int, timeout time.Duration) []Harvest {
+	t.Helper()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		s.lk.Lock()
+		if len(s.harvests) >= n && s.unhandled == 0 {
+			harvests := append([]Harvest(nil), s.harvests...)
+			s.lk.Unlock()
+			return harvests
+		}
+		received := s.received
+		s.lk.Unlock()
+
+		select {
+		case <-received:
+		case <-deadline.C:
+			t.Fatalf("gorelictest: got %d harvests, want %d within %v", len(s.Harvests()), n, timeout)
+			return nil
+		}
+	}
+}
+
+// AssertMetric fails the test unless the latest harvest reporting name has
+// the given value.
+func (s *Server) AssertMetric(t testing.TB, name string, value float64) {
+	t.Helper()
+	v, ok := s.Metric(name)
+	if !ok {
+		t.Errorf("gorelictest: metric %s was not reported", name)
+		return
+	}
+	if !floatEqual(v.Value, value) {
+		t.Errorf("gorelictest: metric %s = %v, want %v", name, v.Value, value)
+	}
+}
+
+// AssertNoMetric fails the test if any harvest reported name.
+func (s *Server) AssertNoMetric(t testing.TB, name string) {
+	t.Helper()
+	if v, ok := s.Metric(name); ok {
+		t.Errorf("gorelictest: metric %s = %v, want it not reported", name, v.Value)
+	}
+}
+
+func floatEqual(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
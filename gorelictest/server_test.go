@@ -0,0 +1,230 @@
+package gorelictest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/courtf/gorelic"
+)
+
+// recordingTB records failures instead of failing the test, to test the
+// assertions themselves.
+type recordingTB struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fatalf(format string, args ...interface{}) {
+	r.Errorf(format, args...)
+}
+
+const testPayload = `{
+	"agent": {"host": "test", "version": "1.0", "pid": 1},
+	"components": [{
+		"name": "app",
+		"guid": "com.example.app",
+		"duration": 60,
+		"metrics": {
+			"Component/Runtime/Goroutines[goroutines]": 12,
+			"Component/HTTP/Throughput/Duration[ms]": {"min": 1, "max": 5, "total": 9, "count": 3, "sum_of_squares": 35}
+		}
+	}]
+}`
+
+func post(t *testing.T, s *Server, body string) int {
+	t.Helper()
+	resp, err := http.Post(s.URL, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestServerRecordsHarvests(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	if _, ok := s.LastHarvest(); ok {
+		t.Error("LastHarvest reported a harvest before any was sent")
+	}
+	if status := post(t, s, testPayload); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if status := post(t, s, "not json"); status != http.StatusBadRequest {
+		t.Errorf("invalid payload status = %d, want 400", status)
+	}
+
+	harvests := s.Harvests()
+	if len(harvests) != 1 {
+		t.Fatalf("got %d harvests, want 1", len(harvests))
+	}
+	h := harvests[0]
+	if h.Payload.Agent.Host != "test" || len(h.Payload.Components) != 1 || h.Payload.Components[0].Duration != 60 {
+		t.Errorf("unexpected payload %+v", h.Payload)
+	}
+
+	tests := []struct {
+		name string
+		want MetricValue
+	}{
+		{"Component/Runtime/Goroutines[goroutines]", MetricValue{Value: 12, Min: 12, Max: 12, Total: 12, Count: 1, SumOfSquares: 144}},
+		{"Runtime/Goroutines", MetricValue{Value: 12, Min: 12, Max: 12, Total: 12, Count: 1, SumOfSquares: 144}},
+		{"HTTP/Throughput/Duration", MetricValue{Value: 3, Min: 1, Max: 5, Total: 9, Count: 3, SumOfSquares: 35}},
+	}
+	for _, tt := range tests {
+		if v, ok := h.Metric(tt.name); !ok || v != tt.want {
+			t.Errorf("Metric(%q) = %+v, %v, want %+v", tt.name, v, ok, tt.want)
+		}
+	}
+	if _, ok := h.Metric("Runtime"); ok {
+		t.Error("Metric matched a path prefix")
+	}
+}
+
+func TestServerFail(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Fail(http.StatusServiceUnavailable, http.StatusForbidden)
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusForbidden, http.StatusOK} {
+		if status := post(t, s, testPayload); status != want {
+			t.Errorf("status = %d, want %d", status, want)
+		}
+	}
+	if n := len(s.Harvests()); n != 1 {
+		t.Errorf("got %d harvests, want only the successful one", n)
+	}
+}
+
+func TestAssertMetric(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	post(t, s, testPayload)
+
+	tests := []struct {
+		name   string
+		value  float64
+		failed bool
+	}{
+		{"Runtime/Goroutines", 12, false},
+		{"Runtime/Goroutines", 12 + 1e-12, false},
+		{"Runtime/Goroutines", 13, true},
+		{"HTTP/Throughput/Duration", 3, false},
+		{"Runtime/Threads", 0, true},
+	}
+	for _, tt := range tests {
+		r := &recordingTB{TB: t}
+		s.AssertMetric(r, tt.name, tt.value)
+		if failed := len(r.failures) > 0; failed != tt.failed {
+			t.Errorf("AssertMetric(%q, %v) failed = %v, want %v: %v", tt.name, tt.value, failed, tt.failed, r.failures)
+		}
+	}
+
+	r := &recordingTB{TB: t}
+	s.AssertNoMetric(r, "Runtime/Threads")
+	if len(r.failures) > 0 {
+		t.Errorf("AssertNoMetric failed for a missing metric: %v", r.failures)
+	}
+	s.AssertNoMetric(r, "Runtime/Goroutines")
+	if len(r.failures) != 1 {
+		t.Errorf("AssertNoMetric did not fail for a reported metric")
+	}
+}
+
+func TestWaitForHarvests(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	done := make(chan Harvest)
+	go func() { done <- s.WaitForHarvest(t, 5*time.Second) }()
+	post(t, s, testPayload)
+	if h := <-done; h.Payload.Agent.Host != "test" {
+		t.Errorf("WaitForHarvest returned %+v", h)
+	}
+
+	post(t, s, testPayload)
+	if harvests := s.WaitForHarvests(t, 2, 5*time.Second); len(harvests) != 2 {
+		t.Errorf("got %d harvests, want 2", len(harvests))
+	}
+
+	r := &recordingTB{TB: t}
+	if harvests := s.WaitForHarvests(r, 3, 10*time.Millisecond); harvests != nil || len(r.failures) != 1 {
+		t.Errorf("WaitForHarvests did not time out: %v, %v", harvests, r.failures)
+	}
+}
+
+// newTestAgent builds an agent reporting to s. The GC and memory stats of
+// go-metrics are process globals, so they are not captured: agents of other
+// tests would race on them.
+func newTestAgent(s *Server) *gorelic.Agent {
+	agent := gorelic.NewAgent()
+	agent.CollectGcStat = false
+	agent.CollectMemoryStat = false
+	s.Configure(agent)
+	return agent
+}
+
+func TestConfigure(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	agent := newTestAgent(s)
+	agent.NewrelicName = "configured"
+	if agent.Endpoint != s.URL || agent.NewrelicLicense == "" {
+		t.Fatalf("Configure set endpoint %q, license %q", agent.Endpoint, agent.NewrelicLicense)
+	}
+	agent.Clock = NewManualClock(time.Unix(0, 0))
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := s.WaitForHarvest(t, 5*time.Second)
+	if key := h.Header.Get("X-License-Key"); key != agent.NewrelicLicense {
+		t.Errorf("license header = %q, want %q", key, agent.NewrelicLicense)
+	}
+	if len(h.Payload.Components) != 1 || h.Payload.Components[0].Name != "configured" {
+		t.Errorf("unexpected components %+v", h.Payload.Components)
+	}
+}
+
+func TestWaitForHarvestWaitsForClear(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	agent := newTestAgent(s)
+	clock := NewManualClock(time.Unix(0, 0))
+	agent.Clock = clock
+	var hooked int
+	agent.AfterHarvest = func(error) { hooked++ }
+	s.Configure(agent)
+	jobs := agent.NewCounter("Jobs", "jobs")
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.WaitForHarvest(t, 5*time.Second)
+	for i := 0; i < 20; i++ {
+		// counted after the agent cleared the counter of the last harvest
+		jobs.Inc(50)
+		if !clock.WaitForTimers(3, 5*time.Second) {
+			t.Fatalf("got %d timers, want 3", clock.Timers())
+		}
+		clock.Advance(time.Duration(agent.NewrelicPollInterval) * time.Second)
+		if v, _ := s.WaitForHarvest(t, 5*time.Second).Metric("Jobs"); v.Value != 50 {
+			t.Fatalf("harvest %d reported %v jobs, want 50", i+2, v.Value)
+		}
+	}
+	if hooked != 21 {
+		t.Errorf("a hook set before Configure was called %d times, want 21", hooked)
+	}
+}
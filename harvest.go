@@ -0,0 +1,244 @@
+package gorelic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// payload is the body of a NewRelic platform API request.
+type payload struct {
+	Agent      *newrelic_platform_go.Agent          `json:"agent"`
+	Components []newrelic_platform_go.ComponentData `json:"components"`
+}
+
+// harvest collects metrics from all components and sends them to NewRelic.
+// After NewRelicFatalThreshold failed harvests in a row, accumulated data is dropped.
+func (agent *Agent) harvest() (err error) {
+	agent.harvestLk.Lock()
+	defer agent.harvestLk.Unlock()
+	if agent.AfterHarvest != nil {
+		defer func() { agent.AfterHarvest(err) }()
+	}
+
+	clock := agent.clock()
+	startTime := clock.Now()
+	agent.stats.startHarvest()
+
+	var status int
+	body, metricCount, err := agent.collect(startTime)
+	if err == nil {
+		if status, err = agent.send(body); err == nil {
+			err = agent.checkResponse(status)
+		}
+	}
+	duration := clock.Now().Sub(startTime)
+	agent.stats.endHarvest(duration, len(body), metricCount, err)
+
+	if err == nil {
+		agent.harvestFailures = 0
+		agent.logger().Debug("harvest sent", "status_code", status, "metrics", metricCount, "bytes", len(body),
+			"duration", duration)
+		return nil
+	}
+
+	agent.harvestFailures++
+	agent.logger().Warn("can not send metrics to NewRelic", "error", err, "status_code", status,
+		"failures", agent.harvestFailures)
+
+	if threshold := agent.settings.fatalErrorThreshold(); threshold > 0 && agent.harvestFailures >= threshold {
+		agent.logger().Error("too many failed harvests, clearing collected data", "failures", agent.harvestFailures)
+		agent.clearSentData()
+		agent.harvestFailures = 0
+	}
+	return err
+}
+
+// collect evaluates all metricas and encodes them into a payload.
+func (agent *Agent) collect(startTime time.Time) (body []byte, metricCount int, err error) {
+	plugin := agent.plugin
+
+	duration := int(agent.settings.harvestInterval().Seconds())
+	if !plugin.LastPollTime.IsZero() {
+		duration = int(startTime.Sub(plugin.LastPollTime).Seconds())
+	}
+
+	p := payload{
+		Agent:      plugin.Agent,
+		Components: make([]newrelic_platform_go.ComponentData, 0, len(plugin.ComponentModels)),
+	}
+	for _, component := range plugin.ComponentModels {
+		component.SetDuration(duration)
+		data := component.Harvest(plugin)
+		if cd, ok := data.(componentData); ok {
+			metricCount += len(cd.Metrics)
+		}
+		p.Components = append(p.Components, data)
+	}
+
+	if body, err = json.Marshal(p); err != nil {
+		return nil, metricCount, fmt.Errorf("can not encode metrics: %v", err)
+	}
+	return body, metricCount, nil
+}
+
+// send posts the encoded metrics to NewRelic, retrying according to
+// Agent.RetryPolicy, and returns the last response status code.
+func (agent *Agent) send(body []byte) (int, error) {
+	policy := agent.RetryPolicy
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := agent.sendOnce(body)
+		if err == nil && !isRetryableStatus(status) {
+			return status, nil
+		}
+		if attempt >= policy.MaxAttempts {
+			return status, err
+		}
+
+		delay := policy.backoff(attempt)
+		if retryAfter > 0 {
+			if policy.MaxBackoff > 0 && retryAfter > policy.MaxBackoff {
+				// NewRelic wants us to wait longer than we may, data will be sent with the next harvest
+				return status, err
+			}
+			delay = retryAfter
+		}
+
+		agent.logger().Info("retrying metrics send", "attempt", attempt+1, "status_code", status,
+			"error", err, "backoff", delay)
+		sleep(agent.clock(), delay)
+	}
+}
+
+// sendOnce posts the encoded metrics to NewRelic and returns the response
+// status code and the Retry-After delay, if any.
+func (agent *Agent) sendOnce(body []byte) (int, time.Duration, error) {
+	agent.cfgLk.Lock()
+	url, license := agent.plugin.URL, agent.plugin.LicenseKey
+	agent.cfgLk.Unlock()
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("X-License-Key", license)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := agent.Client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), agent.clock().Now())
+	return resp.StatusCode, retryAfter, nil
+}
+
+// checkResponse clears sent data when NewRelic accepted (or will never accept)
+// it, and returns an error for every status but 200.
+func (agent *Agent) checkResponse(status int) error {
+	switch status {
+	case http.StatusOK:
+		agent.clearSentData()
+		return nil
+	case http.StatusForbidden:
+		return fmt.Errorf("authentication error (no license key header, or invalid license key)")
+	case http.StatusBadRequest:
+		return fmt.Errorf("the request or headers are in the wrong format or the URL is incorrect")
+	case http.StatusNotFound:
+		return fmt.Errorf("invalid URL")
+	case http.StatusRequestEntityTooLarge:
+		// too many metrics or components in one request, resending will not help
+		agent.clearSentData()
+		return fmt.Errorf("request entity too large, metrics discarded")
+	default:
+		return fmt.Errorf("got %d response code, metrics will be aggregated", status)
+	}
+}
+
+// clearSentData resets metricas after their data was sent (or dropped) and
+// starts a new harvest period.
+func (agent *Agent) clearSentData() {
+	agent.plugin.ClearSentData()
+	agent.plugin.LastPollTime = agent.clock().Now()
+}
+
+// SnapshotMetric is a single metric evaluated by Agent.Harvest.
+type SnapshotMetric struct {
+	Name  string
+	Units string
+	Value float64
+	// Aggregate is set for AggregateMetricas, Value is its mean then.
+	Aggregate *newrelic_platform_go.AggregatedMetricaValue
+	// Err is the error returned by the metrica, Value is 0 then.
+	Err error
+}
+
+// Snapshot holds the values of all metrics at the time of Agent.Harvest.
+type Snapshot struct {
+	Time    time.Time
+	Metrics []SnapshotMetric
+}
+
+// Get returns the metric with the given name, e.g. "HTTP/Throughput/Rate1".
+func (snapshot Snapshot) Get(name string) (SnapshotMetric, bool) {
+	for _, m := range snapshot.Metrics {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return SnapshotMetric{}, false
+}
+
+// Harvest synchronously evaluates every metric reported by the agent (runtime,
+// GC, memory, HTTP, tracer, custom) without sending anything. Metrics of
+// disabled collectors are skipped. It returns an empty Snapshot before Run.
+func (agent *Agent) Harvest() Snapshot {
+	return agent.snapshot(false)
+}
+
+// HarvestAndClear is like Harvest, but afterwards clears metrics the way a
+// successful send does: counters are reset and a new harvest period starts.
+func (agent *Agent) HarvestAndClear() Snapshot {
+	return agent.snapshot(true)
+}
+
+func (agent *Agent) snapshot(clearSent bool) Snapshot {
+	if atomic.LoadUint32(&agent.running) == 0 {
+		return Snapshot{Time: agent.clock().Now()}
+	}
+
+	agent.harvestLk.Lock()
+	defer agent.harvestLk.Unlock()
+
+	snapshot := Snapshot{Time: agent.clock().Now()}
+	for _, model := range agent.plugin.ComponentModels {
+		if c, ok := model.(*component); ok {
+			snapshot.Metrics = append(snapshot.Metrics, c.snapshot()...)
+		}
+	}
+
+	if clearSent {
+		agent.clearSentData()
+	}
+	return snapshot
+}
+
+// Flush sends collected metrics to NewRelic right away, e.g. before a short
+// lived process exits. It returns the error of the send, if any.
+func (agent *Agent) Flush() error {
+	if atomic.LoadUint32(&agent.running) == 0 {
+		return errors.New("agent is not running")
+	}
+	return agent.harvest()
+}
@@ -0,0 +1,198 @@
+package gorelic_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/gorelic"
+	"github.com/courtf/gorelic/gorelictest"
+)
+
+func TestHarvestDoesNotUseUpDeltas(t *testing.T) {
+	srv := gorelictest.NewServer()
+	defer srv.Close()
+
+	agent := gorelic.NewAgent()
+	srv.Configure(agent)
+	agent.Clock = gorelictest.NewManualClock(time.Unix(0, 0))
+
+	ds := gorelic.NewDataSource(metrics.NewRegistry())
+	gauge := metrics.NewGauge()
+	ds.Register("jobs", gauge)
+	agent.AddCustomMetric(gorelic.NewGaugeDeltaMetrica(ds, "jobs", "Jobs/Done", "jobs"))
+
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	srv.WaitForHarvest(t, 5*time.Second)
+
+	gauge.Update(100)
+	if m, ok := agent.Harvest().Get("Jobs/Done"); !ok || m.Value != 100 {
+		t.Errorf("snapshot: got %+v, want 100", m)
+	}
+	if err := agent.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	srv.AssertMetric(t, "Jobs/Done", 100)
+
+	gauge.Update(130)
+	if err := agent.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	srv.AssertMetric(t, "Jobs/Done", 30)
+}
+
+// failingMetrica never returns a value.
+type failingMetrica struct{}
+
+func (failingMetrica) GetName() string  { return "Jobs/Broken" }
+func (failingMetrica) GetUnits() string { return "jobs" }
+func (failingMetrica) GetValue() (float64, error) {
+	return 0, errors.New("no value")
+}
+func (failingMetrica) ClearSentData() {}
+
+func TestAgentStatsThroughCollector(t *testing.T) {
+	srv := gorelictest.NewServer()
+	defer srv.Close()
+
+	harvested := make(chan error, 1)
+	agent := gorelic.NewAgent()
+	agent.CollectGcStat = false
+	agent.CollectMemoryStat = false
+	agent.RetryPolicy = gorelic.RetryPolicy{MaxAttempts: 1}
+	agent.AfterHarvest = func(err error) { harvested <- err }
+	srv.Configure(agent)
+	clock := gorelictest.NewManualClock(time.Unix(1000, 0))
+	agent.Clock = clock
+	agent.AddCustomMetric(failingMetrica{})
+
+	if stats := agent.Stats(); stats.Harvests != 0 || stats.Healthy(time.Hour) {
+		t.Errorf("before Run: %+v, healthy %v", stats, stats.Healthy(time.Hour))
+	}
+
+	// the first harvest, started by Run, fails
+	srv.Fail(http.StatusServiceUnavailable)
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-harvested; err == nil {
+		t.Fatal("first harvest succeeded, want 503")
+	}
+	stats := agent.Stats()
+	if stats.Harvests != 1 || stats.HarvestFailures != 1 || stats.ConsecutiveFailures != 1 || stats.LastError == nil {
+		t.Errorf("after a failure: %+v", stats)
+	}
+	if stats.MetricErrors != 1 {
+		t.Errorf("MetricErrors = %d, want 1", stats.MetricErrors)
+	}
+	if stats.Healthy(time.Hour) {
+		t.Error("healthy before any successful harvest")
+	}
+
+	srv.Fail(http.StatusInternalServerError)
+	if err := agent.Flush(); err == nil {
+		t.Fatal("second harvest succeeded, want 500")
+	}
+	<-harvested
+	if stats := agent.Stats(); stats.HarvestFailures != 2 || stats.ConsecutiveFailures != 2 {
+		t.Errorf("after 2 failures: %+v", stats)
+	}
+
+	// the successful harvest reports the failures and metric errors before it
+	if err := agent.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	<-harvested
+	srv.AssertMetric(t, "Agent/Harvest/Failures", 2)
+	srv.AssertMetric(t, "Agent/Metrics/Errors", 1)
+	srv.AssertMetric(t, "Agent/Harvest/LastSuccess", 0)
+	srv.AssertNoMetric(t, "Jobs/Broken")
+	stats = agent.Stats()
+	if stats.Harvests != 3 || stats.HarvestFailures != 2 || stats.ConsecutiveFailures != 0 || !stats.LastSuccess.Equal(clock.Now()) {
+		t.Errorf("after success: %+v", stats)
+	}
+	if stats.MetricCount == 0 || stats.LastPayloadBytes == 0 {
+		t.Errorf("MetricCount %d, LastPayloadBytes %d, want both set", stats.MetricCount, stats.LastPayloadBytes)
+	}
+	if !stats.Healthy(time.Minute) {
+		t.Errorf("unhealthy right after a success: %+v", stats)
+	}
+
+	// stats age with the clock, and the last success is reported
+	clock.Advance(30 * time.Second)
+	if stats := agent.Stats(); stats.Healthy(10*time.Second) || !stats.Healthy(time.Minute) {
+		t.Errorf("30s after success: Healthy(10s) %v, Healthy(1m) %v", stats.Healthy(10*time.Second), stats.Healthy(time.Minute))
+	}
+	if err := agent.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	<-harvested
+	srv.AssertMetric(t, "Agent/Harvest/Failures", 0)
+	srv.AssertMetric(t, "Agent/Harvest/LastSuccess", 1000)
+	srv.AssertMetric(t, "Agent/Harvest/SinceLastSuccess", 30)
+
+	// a single failure makes the agent unhealthy
+	srv.Fail(http.StatusServiceUnavailable)
+	if err := agent.Flush(); err == nil {
+		t.Fatal("harvest succeeded, want 503")
+	}
+	<-harvested
+	if stats := agent.Stats(); stats.Healthy(time.Hour) || stats.ConsecutiveFailures != 1 {
+		t.Errorf("after a failure following success: %+v", stats)
+	}
+}
+
+func TestAgentStatsRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       gorelic.RetryPolicy
+		failures     []int
+		wantErr      bool
+		wantFailures float64
+	}{
+		{"no retries", gorelic.RetryPolicy{MaxAttempts: 1}, []int{503}, true, 1},
+		{"retry succeeds", gorelic.RetryPolicy{MaxAttempts: 3}, []int{503, 429}, false, 0},
+		{"retries run out", gorelic.RetryPolicy{MaxAttempts: 2}, []int{503, 503}, true, 1},
+		{"not retryable", gorelic.RetryPolicy{MaxAttempts: 3}, []int{403}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := gorelictest.NewServer()
+			defer srv.Close()
+
+			agent := gorelic.NewAgent()
+			agent.CollectGcStat = false
+			agent.CollectMemoryStat = false
+			agent.RetryPolicy = tt.policy
+			srv.Configure(agent)
+			agent.Clock = gorelictest.NewManualClock(time.Unix(1000, 0))
+
+			if err := agent.Run(); err != nil {
+				t.Fatal(err)
+			}
+			srv.WaitForHarvest(t, 5*time.Second)
+
+			srv.Fail(tt.failures...)
+			if err := agent.Flush(); (err != nil) != tt.wantErr {
+				t.Fatalf("Flush: %v, want error %v", err, tt.wantErr)
+			}
+			stats := agent.Stats()
+			if want := int64(tt.wantFailures); stats.Harvests != 2 || stats.HarvestFailures != want {
+				t.Errorf("Harvests %d, HarvestFailures %d, want 2, %d", stats.Harvests, stats.HarvestFailures, want)
+			}
+			if stats.Healthy(time.Minute) == tt.wantErr {
+				t.Errorf("Healthy = %v after Flush error %v", !tt.wantErr, tt.wantErr)
+			}
+
+			// the next harvest reports the failed ones
+			if err := agent.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			srv.AssertMetric(t, "Agent/Harvest/Failures", tt.wantFailures)
+		})
+	}
+}
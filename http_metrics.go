@@ -1,9 +1,14 @@
 package gorelic
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/courtf/go-metrics"
@@ -12,47 +17,513 @@ import (
 
 type tHTTPHandlerFunc func(http.ResponseWriter, *http.Request)
 type tHTTPHandler struct {
-	originalHandler     http.Handler
-	originalHandlerFunc tHTTPHandlerFunc
-	isFunc              bool
-	timer               metrics.Timer
+	originalHandler http.Handler
+	timer           metrics.Timer
+	concurrency     *httpConcurrency
+	clock           Clock
 }
 
 var httpTimer metrics.Timer
 
-func newHTTPHandlerFunc(h tHTTPHandlerFunc) *tHTTPHandler {
-	return &tHTTPHandler{
-		isFunc:              true,
-		originalHandlerFunc: h,
-	}
-}
-
 func newHTTPHandler(h http.Handler) *tHTTPHandler {
 	return &tHTTPHandler{
-		isFunc:          false,
 		originalHandler: h,
 	}
 }
 
 func (handler *tHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	startTime := time.Now()
-	defer handler.timer.UpdateSince(startTime)
+	handler.serve(w, req, false)
+}
+
+// handlerPanic is a panic recovered from the original handler.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// serve calls the original handler and returns how long it took. With
+// recoverPanic, a panic of the handler is recovered and returned, except for
+// http.ErrAbortHandler.
+func (handler *tHTTPHandler) serve(w http.ResponseWriter, req *http.Request, recoverPanic bool) (d time.Duration, p *handlerPanic) {
+	handler.concurrency.begin()
+	startTime := handler.clock.Now()
+	defer func() {
+		d = handler.clock.Now().Sub(startTime)
+		handler.timer.Update(d)
+		handler.concurrency.end()
+
+		if !recoverPanic {
+			return
+		}
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			p = &handlerPanic{v, debug.Stack()}
+		}
+	}()
+
+	handler.originalHandler.ServeHTTP(w, req)
+	return
+}
+
+// PanicSample is a panic recovered from a wrapped HTTP handler.
+type PanicSample struct {
+	Time time.Time
+	// Route is the route name: Request.Pattern unless set by WithRouteName.
+	Route string
+	// Value is the panic value formatted with fmt.Sprint.
+	Value string
+	Stack string
+}
+
+// httpPanics counts panics recovered from wrapped handlers and keeps the
+// last of them.
+type httpPanics struct {
+	ds       LabeledDataSource
+	perRoute bool
+	size     int
+
+	lk      sync.Mutex
+	samples []PanicSample
+}
+
+func newHTTPPanics(ds LabeledDataSource, perRoute bool, size int) *httpPanics {
+	ds.Register(httpPanicsDataSourceKey, metrics.NewCounter())
+	return &httpPanics{ds: ds, perRoute: perRoute, size: size}
+}
+
+func (p *httpPanics) record(hp *handlerPanic, route string) {
+	p.ds.IncCounterForKey(httpPanicsDataSourceKey, 1)
+	if p.perRoute {
+		p.ds.IncCounter(httpPanicsDataSourceKey, 1, Label{"route", route})
+	}
+	if p.size <= 0 {
+		return
+	}
+
+	sample := PanicSample{clockOf(p.ds).Now(), route, fmt.Sprint(hp.value), string(hp.stack)}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if len(p.samples) < p.size {
+		p.samples = append(p.samples, sample)
+		return
+	}
+	copy(p.samples, p.samples[1:])
+	p.samples[len(p.samples)-1] = sample
+}
+
+// httpPanicsPerRouteSource reports panics of every route under HTTP/Panics/route/<route>.
+func httpPanicsPerRouteSource(ds LabeledDataSource) MetricaSource {
+	return NewLabeledMetricas(ds, httpPanicsDataSourceKey, "HTTP/Panics", func(ds DataSource, key, path string) []newrelic_platform_go.IMetrica {
+		return []newrelic_platform_go.IMetrica{NewCounterMetrica(ds, key, path, "panics")}
+	})
+}
 
-	if handler.isFunc {
-		handler.originalHandlerFunc(w, req)
-	} else {
-		handler.originalHandler.ServeHTTP(w, req)
+// Panics returns the last panics recovered from wrapped HTTP handlers, oldest
+// first, e.g. to be shown on a debug page (see PanicsHandler). See RecoverPanics.
+func (agent *Agent) Panics() []PanicSample {
+	if agent.httpPanics == nil {
+		return nil
 	}
+	agent.httpPanics.lk.Lock()
+	defer agent.httpPanics.lk.Unlock()
+	return append([]PanicSample(nil), agent.httpPanics.samples...)
 }
 
-func addHTTPMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, timerKey string) {
+// PanicsHandler serves Panics as a JSON array, e.g. to be mounted on a debug
+// mux. Stacks show the code of the application, so it must not be reachable
+// from the outside.
+func (agent *Agent) PanicsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		samples := agent.Panics()
+		if samples == nil {
+			samples = []PanicSample{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(samples); err != nil {
+			agent.logger().Debug("can not write panic samples", "error", err)
+		}
+	})
+}
+
+func addHTTPMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, timerKey string, stats TimerStats) {
 	addTimerMeterMetrics(component, ds, timerKey, "HTTP/Throughput/", "rps")
-	addTimerHistogramMetrics(component, ds, timerKey, "HTTP/Throughput/")
+	addTimerHistogramMetrics(component, ds, timerKey, "HTTP/Throughput/", stats)
+}
+
+// httpMethodOther is the method requests with non standard methods are
+// reported under, so clients can not create new metrics.
+const httpMethodOther = "OTHER"
+
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace, httpMethodOther,
+}
+
+// httpMethodTimers holds a timer per HTTP method.
+type httpMethodTimers map[string]metrics.Timer
+
+func newHTTPMethodTimers(ds DataSource, newTimer func() metrics.Timer) httpMethodTimers {
+	timers := make(httpMethodTimers, len(httpMethods))
+	for _, method := range httpMethods {
+		timers[method] = newTimer()
+		ds.Register(httpMethodDataSourceKey+method, timers[method])
+	}
+	return timers
+}
+
+func (timers httpMethodTimers) update(method string, d time.Duration) {
+	if timers == nil {
+		return
+	}
+	timer, ok := timers[method]
+	if !ok {
+		timer = timers[httpMethodOther]
+	}
+	timer.Update(d)
+}
+
+// addHTTPMethodMetricsToComponent reports the timer of every method under HTTP/Method/<method>/.
+func addHTTPMethodMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, stats TimerStats) {
+	for _, method := range httpMethods {
+		basePath := filepath.Join("HTTP/Method", method) + "/"
+		addTimerMeterMetrics(component, ds, httpMethodDataSourceKey+method, basePath, "rps")
+		addTimerHistogramMetrics(component, ds, httpMethodDataSourceKey+method, basePath, stats)
+	}
+}
+
+// SlowRequest is a request to a wrapped HTTP handler which took longer than
+// Agent.SlowRequestThreshold.
+type SlowRequest struct {
+	// Time is when the request finished.
+	Time   time.Time
+	Method string
+	// Route is the route name (Request.Pattern unless set by WithRouteName)
+	// or, without one, the URL path.
+	Route      string
+	Status     int
+	Duration   time.Duration
+	RemoteAddr string
+	UserAgent  string
+	// Error and Attributes are set with Transaction.NoticeError and
+	// Transaction.AddAttribute.
+	Error      string
+	Attributes map[string]interface{}
+}
+
+// slowRequests keeps the last slow requests.
+type slowRequests struct {
+	size int
+
+	lk       sync.Mutex
+	requests []SlowRequest
+}
+
+func (s *slowRequests) record(r SlowRequest) {
+	if s.size <= 0 {
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if len(s.requests) < s.size {
+		s.requests = append(s.requests, r)
+		return
+	}
+	copy(s.requests, s.requests[1:])
+	s.requests[len(s.requests)-1] = r
 }
 
+func (agent *Agent) recordSlowRequest(req *http.Request, route string, status int, d time.Duration, txn *Transaction) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if route == "" {
+		route = req.URL.Path
+	}
+
+	r := SlowRequest{clockOf(agent.dataSource).Now(), req.Method, route, status, d, req.RemoteAddr, req.UserAgent(),
+		"", txn.attributesCopy()}
+	if err := txn.Err(); err != nil {
+		r.Error = err.Error()
+	}
+	agent.slowRequests.record(r)
+	if agent.LogSlowRequests {
+		agent.logger().Warn("slow request", "method", r.Method, "route", r.Route, "status", r.Status,
+			"duration", r.Duration, "remote_addr", r.RemoteAddr, "user_agent", r.UserAgent, "error", r.Error)
+	}
+}
+
+// SlowRequests returns the last requests to wrapped HTTP handlers which took
+// longer than SlowRequestThreshold, oldest first.
+func (agent *Agent) SlowRequests() []SlowRequest {
+	if agent.slowRequests == nil {
+		return nil
+	}
+	agent.slowRequests.lk.Lock()
+	defer agent.slowRequests.lk.Unlock()
+	return append([]SlowRequest(nil), agent.slowRequests.requests...)
+}
+
+// httpConcurrency tracks requests served by wrapped handlers at the same time.
+type httpConcurrency struct {
+	inFlight int64
+	// peak is the highest inFlight since the last successful harvest.
+	peak int64
+	// histogram gets the number of requests in flight whenever one starts.
+	histogram metrics.Histogram
+}
+
+func (c *httpConcurrency) begin() {
+	n := atomic.AddInt64(&c.inFlight, 1)
+	for {
+		peak := atomic.LoadInt64(&c.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&c.peak, peak, n) {
+			break
+		}
+	}
+	c.histogram.Update(n)
+}
+
+func (c *httpConcurrency) end() {
+	atomic.AddInt64(&c.inFlight, -1)
+}
+
+// concurrencyMetrica reports the current or peak number of requests in flight.
+type concurrencyMetrica struct {
+	path        string
+	concurrency *httpConcurrency
+	peak        bool
+}
+
+func (metrica *concurrencyMetrica) GetName() string {
+	return metrica.path
+}
+func (metrica *concurrencyMetrica) GetUnits() string {
+	return "requests"
+}
+func (metrica *concurrencyMetrica) GetValue() (float64, error) {
+	if metrica.peak {
+		return float64(atomic.LoadInt64(&metrica.concurrency.peak)), nil
+	}
+	return float64(atomic.LoadInt64(&metrica.concurrency.inFlight)), nil
+}
+func (metrica *concurrencyMetrica) ClearSentData() {
+	if metrica.peak {
+		// the next period starts with the requests still in flight
+		atomic.StoreInt64(&metrica.concurrency.peak, atomic.LoadInt64(&metrica.concurrency.inFlight))
+	}
+}
+
+func addHTTPConcurrencyMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, concurrency *httpConcurrency,
+	stats HistogramStats) {
+	component.AddMetrica(&concurrencyMetrica{"HTTP/Concurrency/InFlight", concurrency, false})
+	component.AddMetrica(&concurrencyMetrica{"HTTP/Concurrency/Peak", concurrency, true})
+	for _, m := range stats.Metricas(ds, httpConcurrencyDataSourceKey, "HTTP/Concurrency/", "requests") {
+		component.AddMetrica(m)
+	}
+}
+
+// httpBytesRateSuffix is added to the histogram keys of request and response
+// sizes to get the keys of their byte meters.
+const httpBytesRateSuffix = ".rate"
+
+// countingReader counts bytes of request bodies without Content-Length.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// recordHTTPBytes records sizes of a request and its response. With a route,
+// they are also recorded in a series labeled by it.
+func recordHTTPBytes(ds LabeledDataSource, in, out int64, route string) {
+	ds.UpdateHistogramForKey(httpBytesInDataSourceKey, in)
+	ds.MarkMeterForKey(httpBytesInDataSourceKey+httpBytesRateSuffix, in)
+	ds.UpdateHistogramForKey(httpBytesOutDataSourceKey, out)
+	ds.MarkMeterForKey(httpBytesOutDataSourceKey+httpBytesRateSuffix, out)
+
+	if route != "" {
+		label := Label{"route", route}
+		ds.UpdateHistogram(httpBytesInDataSourceKey, in, label)
+		ds.MarkMeter(httpBytesInDataSourceKey+httpBytesRateSuffix, in, label)
+		ds.UpdateHistogram(httpBytesOutDataSourceKey, out, label)
+		ds.MarkMeter(httpBytesOutDataSourceKey+httpBytesRateSuffix, out, label)
+	}
+}
+
+var httpBytesPaths = []struct{ key, path string }{
+	{httpBytesInDataSourceKey, "HTTP/Bytes/In"},
+	{httpBytesOutDataSourceKey, "HTTP/Bytes/Out"},
+}
+
+func addHTTPBytesMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, stats HistogramStats) {
+	for _, p := range httpBytesPaths {
+		for _, m := range stats.Metricas(ds, p.key, p.path, "bytes") {
+			component.AddMetrica(m)
+		}
+		for _, m := range GetMeterMetrica(ds, p.key+httpBytesRateSuffix, p.path, "bytes/second") {
+			component.AddMetrica(m)
+		}
+	}
+}
+
+// httpBytesPerRouteSources reports sizes of every route under
+// HTTP/Bytes/In/route/<route>/ and HTTP/Bytes/Out/route/<route>/.
+func httpBytesPerRouteSources(ds LabeledDataSource, stats HistogramStats) []MetricaSource {
+	var sources []MetricaSource
+	for _, p := range httpBytesPaths {
+		sources = append(sources,
+			NewLabeledMetricas(ds, p.key, p.path, func(ds DataSource, key, path string) []newrelic_platform_go.IMetrica {
+				return stats.Metricas(ds, key, path, "bytes")
+			}),
+			NewLabeledMetricas(ds, p.key+httpBytesRateSuffix, p.path, func(ds DataSource, key, path string) []newrelic_platform_go.IMetrica {
+				return GetMeterMetrica(ds, key, path, "bytes/second")
+			}))
+	}
+	return sources
+}
+
+var httpStatusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// httpStatuses counts responses by status code and class. Counters are kept
+// indexed by code, so counting a response takes neither locks nor allocations.
+// Codes from 100 to 599 missing in the predefined list are registered when
+// they are first seen and reported as a MetricaSource; other codes are only
+// counted in the total.
+type httpStatuses struct {
+	ds      DataSource
+	codes   bool
+	enabled func() bool
+
+	total   metrics.Counter
+	classes [5]metrics.Counter
+	// byCode holds the metrics.Counter of code 100+i, nil until it is registered
+	byCode [500]atomic.Value
+
+	lk    sync.Mutex
+	extra []newrelic_platform_go.IMetrica
+}
+
+func newHTTPStatuses(ds DataSource, codes bool, enabled func() bool, predefined []int) *httpStatuses {
+	s := &httpStatuses{ds: ds, codes: codes, enabled: enabled, total: metrics.NewCounter()}
+	ds.Register(httpStatusTotalDataSourceKey, s.total)
+	for i, class := range httpStatusClasses {
+		s.classes[i] = metrics.NewCounter()
+		ds.Register(httpStatusClassDataSourceKey+class, s.classes[i])
+	}
+	for _, status := range predefined {
+		counter := metrics.NewCounter()
+		ds.Register(statusKeyFunc(status), counter)
+		if status >= 100 && status < 600 {
+			s.byCode[status-100].Store(counter)
+		}
+	}
+	return s
+}
+
+func (s *httpStatuses) record(status int) {
+	s.total.Inc(1)
+	s.add(status, 1)
+}
+
+// replace counts a response recorded with status old as one with status new.
+func (s *httpStatuses) replace(old, new int) {
+	s.add(old, -1)
+	s.add(new, 1)
+}
+
+// add adds n to the counters of the class and code of status.
+func (s *httpStatuses) add(status int, n int64) {
+	if status < 100 || status >= 600 {
+		return
+	}
+	s.classes[status/100-1].Inc(n)
+	if !s.codes {
+		return
+	}
+
+	counter, _ := s.byCode[status-100].Load().(metrics.Counter)
+	if counter == nil {
+		counter = s.register(status)
+	}
+	counter.Inc(n)
+}
+
+// register creates the counter of a code seen for the first time.
+func (s *httpStatuses) register(status int) metrics.Counter {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if counter, ok := s.byCode[status-100].Load().(metrics.Counter); ok {
+		return counter
+	}
+
+	key := statusKeyFunc(status)
+	var counter metrics.Counter = metrics.NewCounter()
+	if err := s.ds.Register(key, counter); err != nil {
+		if existing, ok := s.ds.Get(key).(metrics.Counter); ok {
+			counter = existing
+		}
+	}
+	s.extra = append(s.extra, toggledMetrica{
+		NewCounterMetrica(s.ds, key, filepath.Join("HTTP/Status/", fmt.Sprintf("%d", status)), "count"),
+		s.enabled,
+	})
+	s.byCode[status-100].Store(counter)
+	return counter
+}
+
+// Metricas returns counters of the codes registered at runtime.
+func (s *httpStatuses) Metricas() []newrelic_platform_go.IMetrica {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]newrelic_platform_go.IMetrica(nil), s.extra...)
+}
+
+// errorRateMetrica reports the share of 5xx responses since the last harvest.
+type errorRateMetrica struct {
+	ds DataSource
+}
+
+func (metrica errorRateMetrica) GetName() string {
+	return "HTTP/ErrorRate"
+}
+func (metrica errorRateMetrica) GetUnits() string {
+	return "ratio"
+}
+func (metrica errorRateMetrica) GetValue() (float64, error) {
+	total, err := metrica.ds.GetCounterValue(httpStatusTotalDataSourceKey)
+	if err != nil || total == 0 {
+		return 0, err
+	}
+	errors, err := metrica.ds.GetCounterValue(httpStatusClassDataSourceKey + "5xx")
+	if err != nil {
+		return 0, err
+	}
+	return errors / total, nil
+}
+func (metrica errorRateMetrica) ClearSentData() {
+	// the 5xx counter is cleared by its own metrica
+	if counter, ok := metrica.ds.Get(httpStatusTotalDataSourceKey).(metrics.Counter); ok {
+		counter.Clear()
+	}
+}
+
+// addHTTPStatusMetricsToComponent adds counters of statuses, of every status
+// class and the error rate.
 func addHTTPStatusMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, statuses []int,
 	keyFunc func(int) string) {
 	for _, s := range statuses {
 		component.AddMetrica(NewCounterMetrica(ds, keyFunc(s), filepath.Join("HTTP/Status/", fmt.Sprintf("%d", s)), "count"))
 	}
+	for _, class := range httpStatusClasses {
+		component.AddMetrica(NewCounterMetrica(ds, httpStatusClassDataSourceKey+class, filepath.Join("HTTP/Status/", class), "count"))
+	}
+	component.AddMetrica(errorRateMetrica{ds})
 }
@@ -0,0 +1,507 @@
+package gorelic
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+// discardWriter is a ResponseWriter which allocates nothing, so allocations
+// measured around it are made by the agent.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Flush()                      {}
+
+// newAllocTestHandler wraps handler with an agent collecting statuses and
+// sampling with r.
+func newAllocTestHandler(t testing.TB, r Reservoir, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	agent := newTestAgent(t)
+	agent.CollectHTTPStatuses = true
+	agent.Reservoir = r
+	h := agent.WrapHTTPHandlerFunc(handler)
+	// settings are synced without Run, whose harvests would allocate
+	// concurrently
+	agent.settings.sync(agent)
+	return h
+}
+
+// newTestAgent builds an agent sending harvests to a collector accepting
+// anything.
+func newTestAgent(t testing.TB) *Agent {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	t.Cleanup(collector.Close)
+
+	agent := NewAgent()
+	agent.NewrelicLicense = "license"
+	agent.Endpoint = collector.URL
+	return agent
+}
+
+func TestWrappedHandlerAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	tests := []struct {
+		reservoir Reservoir
+		allocs    float64
+	}{
+		{Reservoir{Kind: HDRReservoir}, 0},
+		{Reservoir{Kind: IntervalReservoir}, 0},
+		// the exp-decay sample of go-metrics, once full, boxes the values it
+		// pushes to and pops from its heap
+		{Reservoir{}, 4},
+	}
+	for _, tt := range tests {
+		statuses := []int{200, 404, 503, 299}
+		var n int
+		h := newAllocTestHandler(t, tt.reservoir, func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(statuses[n%len(statuses)])
+			n++
+			w.(http.Flusher).Flush()
+		})
+		w := &discardWriter{http.Header{}}
+		req := httptest.NewRequest("GET", "/", nil)
+
+		// the first requests fill the pools, register status codes and
+		// the exp-decay reservoir
+		for i := 0; i < 2*DefaultReservoirSize; i++ {
+			h(w, req)
+		}
+		if allocs := testing.AllocsPerRun(1000, func() { h(w, req) }); allocs > tt.allocs {
+			t.Errorf("%v reservoir: wrapped handler allocates %v times per request, want at most %v",
+				tt.reservoir.Kind, allocs, tt.allocs)
+		}
+	}
+}
+
+func BenchmarkWrappedHandler(b *testing.B) {
+	h := newAllocTestHandler(b, Reservoir{Kind: HDRReservoir}, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	w := &discardWriter{http.Header{}}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h(w, req)
+	}
+}
+
+func TestHTTPBytesPerRouteReservoir(t *testing.T) {
+	agent := newTestAgent(t)
+	agent.CollectHTTPBytes = true
+	agent.HTTPBytesPerRoute = true
+	agent.Reservoir = Reservoir{Kind: IntervalReservoir}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /upload", func(w http.ResponseWriter, req *http.Request) {})
+	h := agent.WrapHTTPHandler(mux)
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("data")))
+
+	series := agent.dataSource.Series(httpBytesInDataSourceKey)
+	if len(series) != 1 {
+		t.Fatalf("got %d series of request sizes, want 1", len(series))
+	}
+	if intervalOf(series[0].Metric) == nil {
+		t.Errorf("sizes of route %v are sampled by %T, want Agent.Reservoir", series[0].Labels, series[0].Metric.(metrics.Histogram).Sample())
+	}
+}
+
+func counterValue(t *testing.T, ds DataSource, key string) float64 {
+	t.Helper()
+	value, err := ds.GetCounterValue(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestPanicAfterWriteHeader(t *testing.T) {
+	agent := newTestAgent(t)
+	agent.CollectHTTPStatuses = true
+	agent.RecoverPanics = true
+	h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("boom")
+	})
+	// settings are synced by Run, whose harvests would clear the counters
+	agent.settings.sync(agent)
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	for key, want := range map[string]float64{
+		httpStatusTotalDataSourceKey:         1,
+		httpStatusClassDataSourceKey + "2xx": 0,
+		httpStatusClassDataSourceKey + "5xx": 1,
+		statusKeyFunc(http.StatusOK):         0,
+		statusKeyFunc(500):                   1,
+		httpPanicsDataSourceKey:              1,
+	} {
+		if got := counterValue(t, agent.dataSource, key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestRepanicLogsStack(t *testing.T) {
+	var log strings.Builder
+	agent := newTestAgent(t)
+	agent.Logger = slog.New(slog.NewTextHandler(&log, nil))
+	agent.RecoverPanics = true
+	agent.RepanicAfterRecover = true
+	h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panicInHandler()
+	})
+
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("recovered %v, want the original panic value", v)
+			}
+		}()
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if !strings.Contains(log.String(), "panic in HTTP handler") || !strings.Contains(log.String(), "panicInHandler") {
+		t.Errorf("the original stack was not logged:\n%s", log.String())
+	}
+}
+
+func panicInHandler() {
+	panic("boom")
+}
+
+func TestMethodTimersEnabledWhileServing(t *testing.T) {
+	agent := newTestAgent(t)
+	h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}
+	}()
+
+	// Run creates the method timers while the handler is serving
+	agent.CollectHTTPMethods = true
+	agent.CollectGcStat = false
+	agent.CollectMemoryStat = false
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		timer, _ := agent.dataSource.Get(httpMethodDataSourceKey + "GET").(metrics.Timer)
+		if timer != nil && timer.Count() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("GET requests were not timed after Run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+}
+
+func TestStatusClasses(t *testing.T) {
+	tests := []struct {
+		name        string
+		classesOnly bool
+		statuses    []int
+		classes     map[string]float64
+		codes       map[int]float64
+		errorRate   float64
+	}{
+		{
+			name:      "codes and classes",
+			statuses:  []int{200, 201, 404, 500, 503, 299},
+			classes:   map[string]float64{"2xx": 3, "4xx": 1, "5xx": 2},
+			codes:     map[int]float64{200: 1, 404: 1, 500: 1, 503: 1, 299: 1},
+			errorRate: 2.0 / 6,
+		},
+		{
+			name:        "classes only",
+			classesOnly: true,
+			statuses:    []int{200, 200, 404, 502},
+			classes:     map[string]float64{"2xx": 2, "4xx": 1, "5xx": 1},
+			codes:       map[int]float64{200: 0, 404: 0, 502: 0},
+			errorRate:   1.0 / 4,
+		},
+		{
+			// codes outside 100-599 count in the total only, and so in the
+			// denominator of the error rate
+			name:        "classes only with unknown codes",
+			classesOnly: true,
+			statuses:    []int{999, 500},
+			classes:     map[string]float64{"5xx": 1},
+			errorRate:   1.0 / 2,
+		},
+		{
+			name:      "no errors",
+			statuses:  []int{302, 101},
+			classes:   map[string]float64{"1xx": 1, "3xx": 1},
+			codes:     map[int]float64{302: 1},
+			errorRate: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t)
+			agent.CollectHTTPStatuses = true
+			agent.HTTPStatusClassesOnly = tt.classesOnly
+			var n int
+			h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(tt.statuses[n])
+				n++
+			})
+			agent.settings.sync(agent)
+			for range tt.statuses {
+				h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+
+			if got := counterValue(t, agent.dataSource, httpStatusTotalDataSourceKey); got != float64(len(tt.statuses)) {
+				t.Errorf("total = %v, want %d", got, len(tt.statuses))
+			}
+			for _, class := range httpStatusClasses {
+				if got := counterValue(t, agent.dataSource, httpStatusClassDataSourceKey+class); got != tt.classes[class] {
+					t.Errorf("%s = %v, want %v", class, got, tt.classes[class])
+				}
+			}
+			for code, want := range tt.codes {
+				if got, _ := agent.dataSource.GetCounterValue(statusKeyFunc(code)); got != want {
+					t.Errorf("%d = %v, want %v", code, got, want)
+				}
+			}
+			if tt.classesOnly {
+				if extra := agent.httpStatuses.Metricas(); len(extra) != 0 {
+					t.Errorf("codes registered with classes only: %d metricas", len(extra))
+				}
+			}
+
+			metrica := errorRateMetrica{agent.dataSource}
+			if got, err := metrica.GetValue(); err != nil || got != tt.errorRate {
+				t.Errorf("error rate = %v, %v, want %v", got, err, tt.errorRate)
+			}
+			metrica.ClearSentData()
+			if got, err := metrica.GetValue(); err != nil || got != 0 {
+				t.Errorf("error rate after clear = %v, %v, want 0", got, err)
+			}
+		})
+	}
+}
+
+func TestMethodTimers(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		want     map[string]int64
+	}{
+		{"known methods", []string{"GET", "GET", "POST", "DELETE"}, map[string]int64{"GET": 2, "POST": 1, "DELETE": 1}},
+		{"other methods", []string{"PURGE", "PROPFIND", "HEAD"}, map[string]int64{httpMethodOther: 2, "HEAD": 1}},
+		// methods are case sensitive
+		{"lower case", []string{"get"}, map[string]int64{httpMethodOther: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t)
+			agent.CollectHTTPMethods = true
+			clock := &sleepClock{now: time.Unix(1000, 0)}
+			agent.Clock = clock
+			h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				clock.now = clock.now.Add(10 * time.Millisecond)
+			})
+			agent.settings.sync(agent)
+			for _, method := range tt.requests {
+				h(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+			}
+
+			for _, method := range httpMethods {
+				timer := agent.dataSource.Get(httpMethodDataSourceKey + method).(metrics.Timer)
+				if got := timer.Count(); got != tt.want[method] {
+					t.Errorf("%s timer count = %d, want %d", method, got, tt.want[method])
+				}
+				if timer.Count() > 0 && timer.Max() != int64(10*time.Millisecond) {
+					t.Errorf("%s timer max = %v, want 10ms", method, time.Duration(timer.Max()))
+				}
+			}
+		})
+	}
+
+	agent := newTestAgent(t)
+	agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	if agent.httpMethods.Load() != nil || agent.dataSource.Get(httpMethodDataSourceKey+"GET") != nil {
+		t.Error("method timers created without CollectHTTPMethods")
+	}
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		d         time.Duration
+		status    int
+		slow      bool
+	}{
+		{"fast", threshold, 50 * time.Millisecond, http.StatusOK, false},
+		{"at threshold", threshold, threshold, http.StatusOK, false},
+		{"above threshold", threshold, threshold + time.Millisecond, http.StatusOK, true},
+		{"slow error", threshold, time.Second, http.StatusBadGateway, true},
+		{"no status written", threshold, time.Second, 0, true},
+		{"disabled", 0, time.Hour, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t)
+			agent.SlowRequestThreshold = tt.threshold
+			clock := &sleepClock{now: time.Unix(1000, 0)}
+			agent.Clock = clock
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, req *http.Request) {
+				clock.now = clock.now.Add(tt.d)
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+			})
+			h := agent.WrapHTTPHandler(mux)
+			agent.settings.sync(agent)
+
+			req := httptest.NewRequest("GET", "/items/1", nil)
+			req.Header.Set("User-Agent", "test")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			slow := agent.SlowRequests()
+			if (len(slow) > 0) != tt.slow {
+				t.Fatalf("got %d slow requests, want slow %v", len(slow), tt.slow)
+			}
+			if !tt.slow {
+				return
+			}
+			want := SlowRequest{
+				Time:       clock.now,
+				Method:     "GET",
+				Route:      "GET /items/{id}",
+				Status:     tt.status,
+				Duration:   tt.d,
+				RemoteAddr: req.RemoteAddr,
+				UserAgent:  "test",
+			}
+			if want.Status == 0 {
+				want.Status = http.StatusOK
+			}
+			if got := slow[0]; got.Time != want.Time || got.Method != want.Method || got.Route != want.Route ||
+				got.Status != want.Status || got.Duration != want.Duration || got.RemoteAddr != want.RemoteAddr ||
+				got.UserAgent != want.UserAgent {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestSlowRequestRing(t *testing.T) {
+	tests := []struct {
+		size     int
+		recorded int
+		want     []int
+	}{
+		{size: 3, recorded: 2, want: []int{0, 1}},
+		{size: 3, recorded: 3, want: []int{0, 1, 2}},
+		{size: 3, recorded: 7, want: []int{4, 5, 6}},
+		{size: 1, recorded: 2, want: []int{1}},
+		{size: 0, recorded: 2, want: nil},
+	}
+	for _, tt := range tests {
+		agent := &Agent{slowRequests: &slowRequests{size: tt.size}}
+		for i := 0; i < tt.recorded; i++ {
+			agent.slowRequests.record(SlowRequest{Status: i})
+		}
+
+		got := agent.SlowRequests()
+		var statuses []int
+		for _, r := range got {
+			statuses = append(statuses, r.Status)
+		}
+		if fmt.Sprint(statuses) != fmt.Sprint(tt.want) {
+			t.Errorf("size %d, %d recorded: got %v, want %v oldest first", tt.size, tt.recorded, statuses, tt.want)
+		}
+		if len(got) > 0 {
+			got[0].Status = -1
+			if agent.SlowRequests()[0].Status == -1 {
+				t.Errorf("size %d: SlowRequests returned the ring itself", tt.size)
+			}
+		}
+	}
+
+	if slow := (&Agent{}).SlowRequests(); slow != nil {
+		t.Errorf("SlowRequests before wrapping a handler = %v", slow)
+	}
+}
+
+func TestPanicsHandler(t *testing.T) {
+	agent := newTestAgent(t)
+	agent.RecoverPanics = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /boom", func(w http.ResponseWriter, req *http.Request) {
+		panicInHandler()
+	})
+	h := agent.WrapHTTPHandler(mux)
+	agent.settings.sync(agent)
+
+	get := func() []PanicSample {
+		t.Helper()
+		w := httptest.NewRecorder()
+		agent.PanicsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/panics", nil))
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var samples []PanicSample
+		if err := json.Unmarshal(w.Body.Bytes(), &samples); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		if samples == nil {
+			t.Errorf("no panics served as %s, want []", w.Body)
+		}
+		return samples
+	}
+
+	if samples := get(); len(samples) != 0 {
+		t.Errorf("got %d panics before any", len(samples))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/boom", nil))
+	samples := get()
+	if len(samples) != 1 {
+		t.Fatalf("got %d panics, want 1", len(samples))
+	}
+	if s := samples[0]; s.Route != "GET /boom" || s.Value != "boom" || !strings.Contains(s.Stack, "panicInHandler") {
+		t.Errorf("got %+v", s)
+	}
+
+	// an agent without wrapped handlers has no panics either
+	w := httptest.NewRecorder()
+	NewAgent().PanicsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/panics", nil))
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("served %s before wrapping a handler, want []", body)
+	}
+}
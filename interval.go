@@ -0,0 +1,157 @@
+package gorelic
+
+import (
+	"sync"
+
+	"github.com/courtf/go-metrics"
+)
+
+// intervalSample collects values of the current harvest interval, while reads
+// return the values of the last interval closed by rotate. The last interval
+// is kept until ClearSentData, so values of failed harvests are merged into
+// the next one instead of being lost. Updates hold the read lock while they
+// write to cur, so rotate never merges an interval still being written to.
+type intervalSample struct {
+	digits int
+
+	lk   sync.RWMutex
+	seq  uint64
+	cur  *hdrSample
+	last *hdrSample
+}
+
+func newIntervalSample(digits int) *intervalSample {
+	return &intervalSample{digits: digits, cur: newHDRSample(digits)}
+}
+
+// rotate closes the current interval, once per harvest seq.
+func (s *intervalSample) rotate(seq uint64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if seq == s.seq {
+		return
+	}
+	s.seq = seq
+
+	if s.last == nil {
+		s.last = s.cur
+	} else {
+		s.last.merge(s.cur)
+	}
+	s.cur = newHDRSample(s.digits)
+}
+
+// clear drops the last interval after it has been sent.
+func (s *intervalSample) clear() {
+	s.lk.Lock()
+	s.last = nil
+	s.lk.Unlock()
+}
+
+// view returns the last interval.
+func (s *intervalSample) view() *hdrSample {
+	s.lk.RLock()
+	defer s.lk.RUnlock()
+	if s.last == nil {
+		return newHDRSample(s.digits)
+	}
+	return s.last
+}
+
+func (s *intervalSample) Clear() {
+	s.lk.Lock()
+	s.cur = newHDRSample(s.digits)
+	s.last = nil
+	s.lk.Unlock()
+}
+
+func (s *intervalSample) Update(v int64) {
+	s.lk.RLock()
+	s.cur.Update(v)
+	s.lk.RUnlock()
+}
+
+func (s *intervalSample) Count() int64                       { return s.view().Count() }
+func (s *intervalSample) Max() int64                         { return s.view().Max() }
+func (s *intervalSample) Mean() float64                      { return s.view().Mean() }
+func (s *intervalSample) Min() int64                         { return s.view().Min() }
+func (s *intervalSample) Percentile(p float64) float64       { return s.view().Percentile(p) }
+func (s *intervalSample) Percentiles(ps []float64) []float64 { return s.view().Percentiles(ps) }
+func (s *intervalSample) Size() int                          { return s.view().Size() }
+func (s *intervalSample) Snapshot() metrics.Sample           { return s.view().Snapshot() }
+func (s *intervalSample) StdDev() float64                    { return s.view().StdDev() }
+func (s *intervalSample) Sum() int64                         { return s.view().Sum() }
+func (s *intervalSample) Values() []int64                    { return s.view().Values() }
+func (s *intervalSample) Variance() float64                  { return s.view().Variance() }
+
+// intervalTimer is a timer with an interval sample. Rates are not windowed.
+type intervalTimer struct {
+	metrics.Timer
+	sample *intervalSample
+}
+
+// newTimerWithSample creates a timer with s, keeping interval samples reachable
+// for metricas.
+func newTimerWithSample(s metrics.Sample) metrics.Timer {
+	histogram, meter := newHistogram(s), metrics.NewMeter()
+	timer := metrics.NewCustomTimer(histogram, meter)
+	if _, ok := histogram.(sampleHistogram); ok {
+		timer = sampleTimer{timer, histogram, meter}
+	}
+	if is, ok := s.(*intervalSample); ok {
+		return &intervalTimer{timer, is}
+	}
+	return timer
+}
+
+// intervalOf returns the interval sample of a timer or histogram, or nil if it
+// has another sample.
+func intervalOf(m interface{}) *intervalSample {
+	switch m := m.(type) {
+	case *intervalTimer:
+		return m.sample
+	case metrics.Histogram:
+		s, _ := m.Sample().(*intervalSample)
+		return s
+	}
+	return nil
+}
+
+// harvestStarter is implemented by metricas which need to know when a harvest
+// begins. seq is different for every harvest.
+type harvestStarter interface {
+	startHarvest(seq uint64)
+}
+
+// rotateInterval closes the interval of the metric behind the metrica, if it
+// has IntervalReservoir.
+func (metrica baseMetrica) rotateInterval(seq uint64) {
+	if s := intervalOf(metrica.dataSource.Get(metrica.dataSourceKey)); s != nil {
+		s.rotate(seq)
+	}
+}
+
+// clearInterval drops the sent interval of the metric behind the metrica.
+func (metrica baseMetrica) clearInterval() {
+	if s := intervalOf(metrica.dataSource.Get(metrica.dataSourceKey)); s != nil {
+		s.clear()
+	}
+}
+
+func (metrica TimerMetrica) startHarvest(seq uint64) {
+	metrica.rotateInterval(seq)
+}
+
+// ClearSentData starts a new interval for timers with IntervalReservoir.
+func (metrica TimerMetrica) ClearSentData() {
+	metrica.clearInterval()
+}
+
+func (metrica HistogramMetrica) startHarvest(seq uint64) {
+	metrica.rotateInterval(seq)
+}
+
+// ClearSentData starts a new interval for histograms with IntervalReservoir.
+func (metrica HistogramMetrica) ClearSentData() {
+	metrica.clearInterval()
+}
@@ -0,0 +1,77 @@
+package gorelic
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIntervalSampleKeepsFailedIntervals(t *testing.T) {
+	s := newIntervalSample(2)
+	for i := int64(1); i <= 10; i++ {
+		s.Update(i)
+	}
+	if s.Count() != 0 {
+		t.Errorf("Count() = %d before the interval is closed, want 0", s.Count())
+	}
+
+	s.rotate(1)
+	s.rotate(1)
+	if s.Count() != 10 || s.Max() != 10 {
+		t.Errorf("Count(), Max() = %d, %d, want 10, 10", s.Count(), s.Max())
+	}
+	// not cleared: the harvest failed and the next one reports both intervals
+	s.Update(20)
+	s.rotate(2)
+	if s.Count() != 11 || s.Max() != 20 {
+		t.Errorf("Count(), Max() = %d, %d after a failed harvest, want 11, 20", s.Count(), s.Max())
+	}
+	s.clear()
+	s.rotate(3)
+	if s.Count() != 0 {
+		t.Errorf("Count() = %d after clear, want 0", s.Count())
+	}
+}
+
+func TestIntervalSampleConcurrentRotate(t *testing.T) {
+	const writers, updates = 8, 5000
+	s := newIntervalSample(2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				s.Update(1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var total int64
+	harvest := func(seq uint64) {
+		s.rotate(seq)
+		total += s.Count()
+		s.clear()
+	}
+	var seq uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		seq++
+		harvest(seq)
+	}
+	harvest(seq + 1)
+
+	if total != writers*updates {
+		t.Errorf("harvests reported %d updates, want %d", total, writers*updates)
+	}
+}
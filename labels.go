@@ -0,0 +1,272 @@
+package gorelic
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// DefaultCardinalityLimit - how many label sets a single metric may have.
+// Updates with further label sets go to one overflow series.
+const DefaultCardinalityLimit = 100
+
+// OverflowLabel marks the series collecting updates beyond the cardinality limit.
+var OverflowLabel = Label{"overflow", "true"}
+
+// Label is a name/value pair identifying one series of a metric.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Series is a single label set of a metric registered in a DataSource.
+type Series struct {
+	// Key is the data source key of the series, e.g. `db.query{table=users}`.
+	// A backslash is put before any of `\,={}` in label names and values.
+	Key    string
+	Labels []Label
+	// Metric is the go-metrics object: metrics.Counter, metrics.Timer etc.
+	Metric interface{}
+}
+
+// labelEscaper escapes the characters which separate labels in series keys,
+// so that no two label sets get the same key.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, "{", `\{`, "}", `\}`)
+
+// seriesKey builds the data source key of a label set. Labels are sorted by
+// name, so the order they are passed in does not matter.
+func seriesKey(key string, labels []Label) (string, []Label) {
+	if len(labels) == 0 {
+		return key, nil
+	}
+
+	sorted := append([]Label(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		labelEscaper.WriteString(&b, l.Name)
+		b.WriteByte('=')
+		labelEscaper.WriteString(&b, l.Value)
+	}
+	b.WriteByte('}')
+	return b.String(), sorted
+}
+
+// seriesIndex keeps track of the label sets registered for every metric.
+type seriesIndex struct {
+	lk     sync.Mutex
+	series map[string][]Series
+	limits map[string]int
+}
+
+func newSeriesIndex() *seriesIndex {
+	return &seriesIndex{
+		series: make(map[string][]Series),
+		limits: make(map[string]int),
+	}
+}
+
+func (ds dataSource) SetCardinalityLimit(key string, limit int) {
+	ds.index.lk.Lock()
+	ds.index.limits[key] = limit
+	ds.index.lk.Unlock()
+}
+
+func (ds dataSource) Series(key string) []Series {
+	ds.index.lk.Lock()
+	defer ds.index.lk.Unlock()
+	return append([]Series(nil), ds.index.series[key]...)
+}
+
+// series returns the metric registered for key and labels, creating it with
+// newMetric on first use.
+func (ds dataSource) series(key string, labels []Label, newMetric func() interface{}) interface{} {
+	sk, sorted := seriesKey(key, labels)
+	if m := ds.Get(sk); m != nil {
+		return m
+	}
+
+	if len(labels) == 0 {
+		return ds.getOrRegister(sk, newMetric)
+	}
+
+	ds.index.lk.Lock()
+	defer ds.index.lk.Unlock()
+
+	if m := ds.Get(sk); m != nil {
+		return m
+	}
+
+	limit, ok := ds.index.limits[key]
+	if !ok {
+		limit = DefaultCardinalityLimit
+	}
+	if len(ds.index.series[key]) >= limit {
+		sk, sorted = seriesKey(key, []Label{OverflowLabel})
+		if m := ds.Get(sk); m != nil {
+			return m
+		}
+	}
+
+	m := ds.getOrRegister(sk, newMetric)
+	ds.index.series[key] = append(ds.index.series[key], Series{sk, sorted, m})
+	return m
+}
+
+func (ds dataSource) getOrRegister(key string, newMetric func() interface{}) interface{} {
+	m := newMetric()
+	if err := ds.Register(key, m); err != nil {
+		return ds.Get(key)
+	}
+	return m
+}
+
+func newCounter() interface{} { return metrics.NewCounter() }
+func newGauge() interface{}   { return metrics.NewGauge() }
+func newMeter() interface{}   { return metrics.NewMeter() }
+
+func (ds dataSource) newHistogram() interface{} {
+	if ds.newSample == nil {
+		return metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	}
+	return newHistogram(ds.newSample())
+}
+
+func (ds dataSource) newTimer() interface{} {
+	if ds.newSample == nil {
+		return metrics.NewTimer()
+	}
+	return newTimerWithSample(ds.newSample())
+}
+
+func (ds dataSource) IncCounter(key string, i int64, labels ...Label) {
+	m := ds.series(key, labels, newCounter)
+	if counter, ok := m.(metrics.Counter); ok {
+		counter.Inc(i)
+	} else {
+		ds.mismatch(key, "counter", m)
+	}
+}
+
+func (ds dataSource) UpdateGauge(key string, i int64, labels ...Label) {
+	m := ds.series(key, labels, newGauge)
+	if gauge, ok := m.(metrics.Gauge); ok {
+		gauge.Update(i)
+	} else {
+		ds.mismatch(key, "gauge", m)
+	}
+}
+
+func (ds dataSource) UpdateHistogram(key string, i int64, labels ...Label) {
+	m := ds.series(key, labels, ds.newHistogram)
+	if histogram, ok := m.(metrics.Histogram); ok {
+		histogram.Update(i)
+	} else {
+		ds.mismatch(key, "histogram", m)
+	}
+}
+
+func (ds dataSource) MarkMeter(key string, i int64, labels ...Label) {
+	m := ds.series(key, labels, newMeter)
+	if meter, ok := m.(metrics.Meter); ok {
+		meter.Mark(i)
+	} else {
+		ds.mismatch(key, "meter", m)
+	}
+}
+
+func (ds dataSource) UpdateTimer(key string, d time.Duration, labels ...Label) {
+	m := ds.series(key, labels, ds.newTimer)
+	if timer, ok := m.(metrics.Timer); ok {
+		timer.Update(d)
+	} else {
+		ds.mismatch(key, "timer", m)
+	}
+}
+
+func (ds dataSource) UpdateTimerSince(key string, t time.Time, labels ...Label) {
+	ds.UpdateTimer(key, ds.clock.Now().Sub(t), labels...)
+}
+
+func (ds dataSource) Time(key string, f func(), labels ...Label) {
+	startTime := ds.clock.Now()
+	f()
+	ds.UpdateTimerSince(key, startTime, labels...)
+}
+
+// MetricaSource provides metricas which are not known up front, e.g. one
+// group per label set. It is asked for them on every harvest.
+type MetricaSource interface {
+	Metricas() []newrelic_platform_go.IMetrica
+}
+
+// LabeledMetricas reports every series of a labeled metric under its own
+// NewRelic path: labels are flattened into the path, so series
+// {table=users,op=select} of "DB/Query" is reported as
+// "DB/Query/op/select/table/users/...".
+type LabeledMetricas struct {
+	ds       LabeledDataSource
+	key      string
+	basePath string
+	build    func(ds DataSource, dataSourceKey, basePath string) []newrelic_platform_go.IMetrica
+
+	lk    sync.Mutex
+	cache map[string][]newrelic_platform_go.IMetrica
+}
+
+// NewLabeledMetricas builds a MetricaSource for the labeled metric key. build
+// creates the metricas of a single series, e.g. GetTimerMetrica.
+func NewLabeledMetricas(ds LabeledDataSource, key, basePath string,
+	build func(ds DataSource, dataSourceKey, basePath string) []newrelic_platform_go.IMetrica) *LabeledMetricas {
+	return &LabeledMetricas{
+		ds:       ds,
+		key:      key,
+		basePath: basePath,
+		build:    build,
+		cache:    make(map[string][]newrelic_platform_go.IMetrica),
+	}
+}
+
+func (lm *LabeledMetricas) Metricas() []newrelic_platform_go.IMetrica {
+	lm.lk.Lock()
+	defer lm.lk.Unlock()
+
+	var ret []newrelic_platform_go.IMetrica
+	for _, s := range lm.ds.Series(lm.key) {
+		ms, ok := lm.cache[s.Key]
+		if !ok {
+			// metricas are kept between harvests, as some of them (deltas) have state
+			ms = lm.build(lm.ds, s.Key, labelsPath(lm.basePath, s.Labels))
+			lm.cache[s.Key] = ms
+		}
+		ret = append(ret, ms...)
+	}
+	return ret
+}
+
+func labelsPath(basePath string, labels []Label) string {
+	parts := []string{basePath}
+	for _, l := range labels {
+		parts = append(parts, pathSegment(l.Name), pathSegment(l.Value))
+	}
+	return filepath.Join(parts...)
+}
+
+// pathSegment makes a label usable as a single NewRelic path segment.
+func pathSegment(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "[", "(", "]", ")").Replace(s)
+}
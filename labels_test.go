@@ -0,0 +1,64 @@
+package gorelic
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		labels []Label
+		key    string
+	}{
+		{nil, "k"},
+		{[]Label{{"table", "users"}, {"op", "select"}}, "k{op=select,table=users}"},
+		{[]Label{{"a", "1,b=2"}}, `k{a=1\,b\=2}`},
+		{[]Label{{"a", "1"}, {"b", "2"}}, "k{a=1,b=2}"},
+		{[]Label{{"a", "x}"}}, `k{a=x\}}`},
+		{[]Label{{"a=b", `c\`}}, `k{a\=b=c\\}`},
+	}
+	for _, tt := range tests {
+		if key, _ := seriesKey("k", tt.labels); key != tt.key {
+			t.Errorf("seriesKey(%v) = %q, want %q", tt.labels, key, tt.key)
+		}
+	}
+}
+
+func TestSeriesDoNotCollide(t *testing.T) {
+	ds := NewDataSource(metrics.NewRegistry())
+	ds.IncCounter("c", 1, Label{"a", "1,b=2"})
+	ds.IncCounter("c", 2, Label{"a", "1"}, Label{"b", "2"})
+	ds.IncCounter("c", 4, Label{"a", "1}"})
+
+	series := ds.Series("c")
+	if len(series) != 3 {
+		t.Fatalf("got %d series, want 3: %v", len(series), series)
+	}
+	for i, want := range []int64{1, 2, 4} {
+		if count := series[i].Metric.(metrics.Counter).Count(); count != want {
+			t.Errorf("series %v counted %d, want %d", series[i].Labels, count, want)
+		}
+	}
+}
+
+func TestSeriesCardinalityLimit(t *testing.T) {
+	ds := NewDataSource(metrics.NewRegistry())
+	ds.SetCardinalityLimit("c", 3)
+	for i := 0; i < 10; i++ {
+		ds.IncCounter("c", 1, Label{"id", fmt.Sprint(i)})
+	}
+
+	series := ds.Series("c")
+	if len(series) != 4 {
+		t.Fatalf("got %d series, want 3 and the overflow one", len(series))
+	}
+	overflow := series[3]
+	if len(overflow.Labels) != 1 || overflow.Labels[0] != OverflowLabel {
+		t.Errorf("last series is %v, want the overflow one", overflow.Labels)
+	}
+	if count := overflow.Metric.(metrics.Counter).Count(); count != 7 {
+		t.Errorf("overflow series counted %d, want 7", count)
+	}
+}
@@ -0,0 +1,44 @@
+package gorelic
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// logOutput is where the default logger writes.
+var logOutput io.Writer = os.Stderr
+
+// verbosityLevel makes the default logger print debug messages only while
+// Agent.Verbose is on. Warnings and errors are always printed. Before Run the
+// agent field is read; runtime settings are synced only by Run and
+// ApplyConfig, which may change it later.
+type verbosityLevel struct {
+	agent *Agent
+}
+
+func (l verbosityLevel) Level() slog.Level {
+	verbose := l.agent.settings.isVerbose()
+	if atomic.LoadUint32(&l.agent.running) == 0 {
+		verbose = l.agent.Verbose
+	}
+	if verbose {
+		return slog.LevelDebug
+	}
+	return slog.LevelWarn
+}
+
+// logger returns Agent.Logger, or a text logger writing to stderr if it is not set.
+func (agent *Agent) logger() *slog.Logger {
+	if agent.Logger != nil {
+		return agent.Logger
+	}
+
+	agent.defaultLoggerOnce.Do(func() {
+		agent.defaultLogger = slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{
+			Level: verbosityLevel{agent},
+		}))
+	})
+	return agent.defaultLogger
+}
@@ -0,0 +1,81 @@
+package gorelic
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out := logOutput
+	logOutput = &buf
+	t.Cleanup(func() { logOutput = out })
+	return &buf
+}
+
+func TestDefaultLoggerVerbosity(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(agent *Agent)
+		verbose bool
+	}{
+		{"quiet", func(agent *Agent) {}, false},
+		{"verbose before Run", func(agent *Agent) { agent.Verbose = true }, true},
+		{"verbose from config before Run", func(agent *Agent) {
+			cfg := NewConfig()
+			cfg.values["verbose"] = configValue{"true", "test"}
+			cfg.Apply(agent)
+		}, true},
+		{"running", func(agent *Agent) {
+			agent.Verbose = true
+			atomic.StoreUint32(&agent.running, 1)
+			agent.settings.sync(agent)
+		}, true},
+		{"running, field changed without ApplyConfig", func(agent *Agent) {
+			atomic.StoreUint32(&agent.running, 1)
+			agent.settings.sync(agent)
+			agent.Verbose = true
+		}, false},
+		{"running, quieted like ApplyConfig does", func(agent *Agent) {
+			agent.Verbose = true
+			atomic.StoreUint32(&agent.running, 1)
+			agent.settings.sync(agent)
+			agent.Verbose = false
+			agent.settings.sync(agent)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := NewAgent()
+			tt.setup(agent)
+			buf := captureLogs(t)
+			agent.logger().Debug("debug message")
+			agent.logger().Warn("warn message")
+
+			if got := strings.Contains(buf.String(), "debug message"); got != tt.verbose {
+				t.Errorf("debug message logged: %v, want %v\n%s", got, tt.verbose, buf)
+			}
+			if !strings.Contains(buf.String(), "warn message") {
+				t.Errorf("warning was not logged\n%s", buf)
+			}
+		})
+	}
+}
+
+func TestAgentLogger(t *testing.T) {
+	buf := captureLogs(t)
+	var own bytes.Buffer
+	agent := NewAgent()
+	agent.Logger = slog.New(slog.NewTextHandler(&own, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	agent.logger().Debug("debug message", "metric", "m")
+	if !strings.Contains(own.String(), "debug message") || !strings.Contains(own.String(), "metric=m") {
+		t.Errorf("Agent.Logger got %q", own.String())
+	}
+	if buf.Len() > 0 {
+		t.Errorf("the default logger got %q", buf)
+	}
+}
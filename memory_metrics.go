@@ -2,16 +2,13 @@ package gorelic
 
 import (
 	"path/filepath"
-	"time"
 
 	"github.com/courtf/go-metrics"
 	"github.com/courtf/newrelic_platform_go"
 )
 
-func addMemoryMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, pollInterval int) {
+func addMemoryMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource) {
 	metrics.RegisterRuntimeMemStats(ds)
-	metrics.CaptureRuntimeMemStatsOnce(ds)
-	go metrics.CaptureRuntimeMemStats(ds, time.Duration(pollInterval)*time.Second)
 
 	basePath := "Runtime/Memory/"
 	curPath := basePath + "InUse/"
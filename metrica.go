@@ -68,9 +68,15 @@ func (metrica GaugeMetrica) GetValue() (float64, error) {
 	return metrica.dataSource.GetGaugeValue(metrica.dataSourceKey)
 }
 
+// GaugeDeltaMetrica reports how much a gauge changed since the last harvest
+// that was sent. Reading it does not move the baseline, ClearSentData does, so
+// Agent.Harvest snapshots do not use up the delta and changes during failed
+// harvests are reported with the next one.
 type GaugeDeltaMetrica struct {
 	baseMetrica
 	previousValue float64
+	readValue     float64
+	read          bool
 }
 
 func NewGaugeDeltaMetrica(ds DataSource, dataSourceKey, path, units string) *GaugeDeltaMetrica {
@@ -87,11 +93,17 @@ func (metrica *GaugeDeltaMetrica) GetValue() (float64, error) {
 	var err error
 	if currentValue, err = metrica.dataSource.GetGaugeValue(metrica.dataSourceKey); err == nil {
 		value = currentValue - metrica.previousValue
-		metrica.previousValue = currentValue
+		metrica.readValue, metrica.read = currentValue, true
 	}
 	return value, err
 }
 
+func (metrica *GaugeDeltaMetrica) ClearSentData() {
+	if metrica.read {
+		metrica.previousValue, metrica.read = metrica.readValue, false
+	}
+}
+
 type HistogramMetrica struct {
 	baseMetrica
 	histFunc   HistogramFunc
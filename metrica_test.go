@@ -0,0 +1,37 @@
+package gorelic
+
+import (
+	"testing"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestGaugeDeltaMetrica(t *testing.T) {
+	ds := NewDataSource(metrics.NewRegistry())
+	gauge := metrics.NewGauge()
+	ds.Register("g", gauge)
+	metrica := NewGaugeDeltaMetrica(ds, "g", "G", "calls")
+
+	value := func(want float64) {
+		t.Helper()
+		if got, err := metrica.GetValue(); err != nil || got != want {
+			t.Errorf("GetValue() = %v, %v, want %v", got, err, want)
+		}
+	}
+
+	gauge.Update(100)
+	value(100)
+	// reads do not move the baseline, a snapshot leaves the delta to the send
+	value(100)
+	gauge.Update(150)
+	value(150)
+	metrica.ClearSentData()
+	value(0)
+	gauge.Update(170)
+	value(20)
+	metrica.ClearSentData()
+	// nothing read since the last clear, the baseline stays
+	metrica.ClearSentData()
+	gauge.Update(180)
+	value(10)
+}
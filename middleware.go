@@ -0,0 +1,90 @@
+package gorelic
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// MiddlewareOption configures a middleware created by Agent.Middleware.
+type MiddlewareOption func(*middlewareOptions)
+
+type middlewareOptions struct {
+	route    func(*http.Request) string
+	filters  []func(*http.Request) bool
+	statuses *bool
+}
+
+// WithRouteName sets how routes are named in per route metrics (Apdex, panics,
+// sizes) and the slow request log. It is called after the request is served,
+// so routers have matched the route by then, e.g. for chi:
+//
+//	gorelic.WithRouteName(func(r *http.Request) string {
+//		return chi.RouteContext(r.Context()).RoutePattern()
+//	})
+//
+// By default routes are named by Request.Pattern of http.ServeMux.
+func WithRouteName(route func(*http.Request) string) MiddlewareOption {
+	return func(o *middlewareOptions) { o.route = route }
+}
+
+// WithRequestFilter passes requests for which filter returns false to the
+// next handler without collecting any metrics for them.
+func WithRequestFilter(filter func(*http.Request) bool) MiddlewareOption {
+	return func(o *middlewareOptions) { o.filters = append(o.filters, filter) }
+}
+
+// WithSkipPaths passes requests to the given URL paths, e.g. health checks,
+// to the next handler without collecting any metrics for them.
+func WithSkipPaths(paths ...string) MiddlewareOption {
+	skip := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		skip[path] = true
+	}
+	return WithRequestFilter(func(req *http.Request) bool { return !skip[req.URL.Path] })
+}
+
+// WithStatuses overrides CollectHTTPStatuses for requests passing the
+// middleware: with true their statuses are counted even if it is off, with
+// false they are never counted. Other handlers keep following
+// CollectHTTPStatuses.
+func WithStatuses(collect bool) MiddlewareOption {
+	return func(o *middlewareOptions) { o.statuses = &collect }
+}
+
+func requestPattern(req *http.Request) string {
+	return req.Pattern
+}
+
+// Middleware returns a middleware collecting the same HTTP metrics as
+// WrapHTTPHandler. It fits routers taking func(http.Handler) http.Handler,
+// e.g. chi's Use and gorilla/mux's Use, and plain handler chains:
+//
+//	http.ListenAndServe(":8080", agent.Middleware(gorelic.WithSkipPaths("/healthz"))(mux))
+func (agent *Agent) Middleware(opts ...MiddlewareOption) func(http.Handler) http.Handler {
+	o := middlewareOptions{route: requestPattern}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.statuses != nil && *o.statuses {
+		atomic.StoreUint32(&agent.forcedStatuses, 1)
+	}
+
+	return func(next http.Handler) http.Handler {
+		pw := agent.wrapHTTPHandler(next)
+		pw.route = o.route
+		pw.statuses = o.statuses
+		if len(o.filters) == 0 {
+			return pw
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for _, filter := range o.filters {
+				if !filter(req) {
+					next.ServeHTTP(w, req)
+					return
+				}
+			}
+			pw.ServeHTTP(w, req)
+		})
+	}
+}
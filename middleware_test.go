@@ -0,0 +1,48 @@
+package gorelic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithStatusesPerHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name       string
+		collect    bool
+		opts       []MiddlewareOption
+		middleware float64
+		plain      float64
+		reported   bool
+	}{
+		{"default off", false, nil, 0, 0, false},
+		{"default on", true, nil, 1, 1, true},
+		{"forced on", false, []MiddlewareOption{WithStatuses(true)}, 1, 0, true},
+		{"forced off", true, []MiddlewareOption{WithStatuses(false)}, 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t)
+			agent.CollectHTTPStatuses = tt.collect
+			mw := agent.Middleware(tt.opts...)(ok)
+			plain := agent.WrapHTTPHandler(ok)
+			agent.settings.sync(agent)
+
+			mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if got := counterValue(t, agent.dataSource, httpStatusTotalDataSourceKey); got != tt.middleware {
+				t.Errorf("middleware counted %v statuses, want %v", got, tt.middleware)
+			}
+			plain.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if got := counterValue(t, agent.dataSource, httpStatusTotalDataSourceKey); got != tt.middleware+tt.plain {
+				t.Errorf("plain handler counted %v statuses, want %v", got-tt.middleware, tt.plain)
+			}
+			if agent.CollectHTTPStatuses != tt.collect {
+				t.Errorf("CollectHTTPStatuses = %v, want %v", agent.CollectHTTPStatuses, tt.collect)
+			}
+			if got := agent.httpStatusesReported(); got != tt.reported {
+				t.Errorf("httpStatusesReported() = %v, want %v", got, tt.reported)
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+//go:build !race
+
+package gorelic
+
+const raceEnabled = false
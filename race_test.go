@@ -0,0 +1,7 @@
+//go:build race
+
+package gorelic
+
+// raceEnabled is set when tests run with the race detector, which makes
+// sync.Pool drop items and so allocates.
+const raceEnabled = true
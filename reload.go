@@ -0,0 +1,287 @@
+package gorelic
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+var errCollectorDisabled = errors.New("collector is disabled")
+
+// runtimeSettings mirrors the Agent fields which may be changed while the agent
+// is running. Harvest and capture loops read them from here, never from Agent.
+type runtimeSettings struct {
+	verbose              uint32
+	collectGC            uint32
+	collectMemory        uint32
+	collectHTTPStatuses  uint32
+	collectHTTPBytes     uint32
+	gcPollInterval       int64
+	memoryPollInterval   int64
+	newrelicPollInterval int64
+	fatalThreshold       int64
+
+	lk      sync.Mutex
+	changed chan struct{}
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func secondsToDuration(seconds int64) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// sync copies the agent fields and wakes up every loop waiting on changes.
+func (s *runtimeSettings) sync(agent *Agent) {
+	atomic.StoreUint32(&s.verbose, boolToUint32(agent.Verbose))
+	atomic.StoreUint32(&s.collectGC, boolToUint32(agent.CollectGcStat))
+	atomic.StoreUint32(&s.collectMemory, boolToUint32(agent.CollectMemoryStat))
+	atomic.StoreUint32(&s.collectHTTPStatuses, boolToUint32(agent.CollectHTTPStatuses))
+	atomic.StoreUint32(&s.collectHTTPBytes, boolToUint32(agent.CollectHTTPBytes))
+	atomic.StoreInt64(&s.gcPollInterval, int64(agent.GCPollInterval))
+	atomic.StoreInt64(&s.memoryPollInterval, int64(agent.MemoryAllocatorPollInterval))
+	atomic.StoreInt64(&s.newrelicPollInterval, int64(agent.NewrelicPollInterval))
+	atomic.StoreInt64(&s.fatalThreshold, int64(agent.NewRelicFatalThreshold))
+
+	s.lk.Lock()
+	if s.changed != nil {
+		close(s.changed)
+	}
+	s.changed = make(chan struct{})
+	s.lk.Unlock()
+}
+
+// wait returns a channel which is closed on the next settings change.
+func (s *runtimeSettings) wait() <-chan struct{} {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
+
+func (s *runtimeSettings) isVerbose() bool {
+	return atomic.LoadUint32(&s.verbose) > 0
+}
+
+func (s *runtimeSettings) gcEnabled() bool {
+	return atomic.LoadUint32(&s.collectGC) > 0
+}
+
+func (s *runtimeSettings) memoryEnabled() bool {
+	return atomic.LoadUint32(&s.collectMemory) > 0
+}
+
+func (s *runtimeSettings) httpStatusesEnabled() bool {
+	return atomic.LoadUint32(&s.collectHTTPStatuses) > 0
+}
+
+func (s *runtimeSettings) httpBytesEnabled() bool {
+	return atomic.LoadUint32(&s.collectHTTPBytes) > 0
+}
+
+func (s *runtimeSettings) gcInterval() time.Duration {
+	return secondsToDuration(atomic.LoadInt64(&s.gcPollInterval))
+}
+
+func (s *runtimeSettings) memoryInterval() time.Duration {
+	return secondsToDuration(atomic.LoadInt64(&s.memoryPollInterval))
+}
+
+func (s *runtimeSettings) harvestInterval() time.Duration {
+	return secondsToDuration(atomic.LoadInt64(&s.newrelicPollInterval))
+}
+
+func (s *runtimeSettings) fatalErrorThreshold() int {
+	return int(atomic.LoadInt64(&s.fatalThreshold))
+}
+
+// toggledComponent wraps every metrica added to it with toggledMetrica, so
+// a whole group of metrics can be switched on and off at runtime.
+type toggledComponent struct {
+	newrelic_platform_go.IComponent
+	enabled func() bool
+}
+
+func (component toggledComponent) AddMetrica(metrica newrelic_platform_go.IMetrica) {
+	component.IComponent.AddMetrica(toggledMetrica{metrica, component.enabled})
+}
+
+// toggledMetrica is not reported while its collector is disabled.
+type toggledMetrica struct {
+	newrelic_platform_go.IMetrica
+	enabled func() bool
+}
+
+func (metrica toggledMetrica) GetValue() (float64, error) {
+	if !metrica.enabled() {
+		return 0, errCollectorDisabled
+	}
+	return metrica.IMetrica.GetValue()
+}
+
+// pollLoop calls capture every interval() while enabled() is true. A new
+// interval takes effect as soon as runtime settings change.
+func (agent *Agent) pollLoop(interval func() time.Duration, enabled func() bool, capture func()) {
+	clock := agent.clock()
+	last := clock.Now()
+	for {
+		changed := agent.settings.wait()
+		d := interval()
+		if d <= 0 {
+			<-changed
+			continue
+		}
+
+		timer := clock.NewTimer(last.Add(d).Sub(clock.Now()))
+		select {
+		case <-changed:
+			timer.Stop()
+			continue
+		case <-timer.C():
+		}
+
+		last = clock.Now()
+		if enabled() {
+			capture()
+		}
+	}
+}
+
+// ApplyConfig applies cfg to a running agent. CollectGcStat, CollectMemoryStat,
+// CollectHTTPStatuses, CollectHTTPBytes, GCPollInterval, MemoryAllocatorPollInterval,
+// NewrelicPollInterval, NewRelicFatalThreshold, Verbose and the license take
+// effect immediately. Changes of other settings are reported as requiring a
+// restart and are not applied, so the agent keeps the values it runs with.
+// Accumulated metrics are kept.
+func (agent *Agent) ApplyConfig(cfg *Config) *ConfigReport {
+	agent.cfgLk.Lock()
+	defer agent.cfgLk.Unlock()
+
+	name, collectHTTP, collectMethods := agent.NewrelicName, agent.CollectHTTPStat, agent.CollectHTTPMethods
+	report := cfg.Apply(agent)
+
+	if atomic.LoadUint32(&agent.running) > 0 {
+		if agent.NewrelicName != name {
+			report.Warnings = append(report.Warnings, "name change requires restart")
+			agent.NewrelicName = name
+		}
+		if agent.CollectHTTPStat != collectHTTP {
+			report.Warnings = append(report.Warnings, "collect_http change requires restart")
+			agent.CollectHTTPStat = collectHTTP
+		}
+		if agent.CollectHTTPMethods != collectMethods {
+			report.Warnings = append(report.Warnings, "collect_http_methods change requires restart")
+			agent.CollectHTTPMethods = collectMethods
+		}
+		agent.plugin.LicenseKey = agent.NewrelicLicense
+	}
+
+	agent.settings.sync(agent)
+	agent.logger().Info("configuration applied", "sources", report.Sources, "warnings", report.Warnings,
+		"errors", len(report.Errors))
+	return report
+}
+
+// Reload reads the config file at path (if path is not empty) and the
+// GORELIC_* environment variables, with the same precedence as
+// NewAgentFromEnv, and applies the result to the agent.
+func (agent *Agent) Reload(path string) *ConfigReport {
+	cfg := NewConfig()
+	var fileErr error
+	if path != "" {
+		fileErr = cfg.LoadFile(path)
+	}
+	cfg.LoadEnv()
+
+	report := agent.ApplyConfig(cfg)
+	if fileErr != nil {
+		report.Errors = append([]error{fileErr}, report.Errors...)
+	}
+	return report
+}
+
+// ReloadOnSignal calls Reload(path) every time the process receives one of
+// sigs (SIGHUP if none given). Call the returned function to stop listening.
+func (agent *Agent) ReloadOnSignal(path string, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ch:
+				agent.logReload(agent.Reload(path))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// WatchConfigFile checks the modification time of the config file at path
+// every interval of Agent.Clock and calls Reload(path) when it changes. Call
+// the returned function to stop watching.
+func (agent *Agent) WatchConfigFile(path string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+
+	clock := agent.clock()
+	go func() {
+		for {
+			timer := clock.NewTimer(interval)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil || fi.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = fi.ModTime()
+			agent.logReload(agent.Reload(path))
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (agent *Agent) logReload(report *ConfigReport) {
+	if err := report.Err(); err != nil {
+		agent.logger().Error("configuration reloaded with errors", "error", err)
+	}
+}
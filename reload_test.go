@@ -0,0 +1,218 @@
+package gorelic_test
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/courtf/gorelic"
+	"github.com/courtf/gorelic/gorelictest"
+)
+
+// logBuffer collects log output of an agent running in other goroutines.
+type logBuffer struct {
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) count(msg string) int {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return strings.Count(b.buf.String(), msg)
+}
+
+// waitFor waits until msg was logged n times.
+func (b *logBuffer) waitFor(t *testing.T, msg string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.count(msg) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q logged %d times, want %d", msg, b.count(msg), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newReloadAgent() (*gorelic.Agent, *gorelictest.ManualClock, *logBuffer) {
+	agent := gorelic.NewAgent()
+	agent.CollectGcStat = false
+	agent.CollectMemoryStat = false
+	clock := gorelictest.NewManualClock(time.Unix(0, 0))
+	agent.Clock = clock
+	logs := &logBuffer{}
+	agent.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	return agent, clock, logs
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadConfig(t *testing.T, content string) *gorelic.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig(t, path, content)
+	cfg, err := gorelic.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestApplyConfigKeepsRestartSettings(t *testing.T) {
+	srv := gorelictest.NewServer()
+	defer srv.Close()
+	agent, _, _ := newReloadAgent()
+	srv.Configure(agent)
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	srv.WaitForHarvest(t, 5*time.Second)
+
+	// warned on every reload, as the running agent keeps its settings
+	for i := 0; i < 2; i++ {
+		report := agent.ApplyConfig(loadConfig(t, "name: other\ncollect_http: true\ncollect_http_methods: true\nverbose: true\n"))
+		want := []string{"name change requires restart", "collect_http change requires restart",
+			"collect_http_methods change requires restart"}
+		if strings.Join(report.Warnings, "\n") != strings.Join(want, "\n") {
+			t.Errorf("reload %d: warnings %v, want %v", i, report.Warnings, want)
+		}
+		if agent.NewrelicName != gorelic.DefaultAgentName || agent.CollectHTTPStat || agent.CollectHTTPMethods {
+			t.Errorf("reload %d: restart settings changed to %q, %v, %v", i, agent.NewrelicName,
+				agent.CollectHTTPStat, agent.CollectHTTPMethods)
+		}
+		if !agent.Verbose {
+			t.Errorf("reload %d: verbose was not applied", i)
+		}
+	}
+}
+
+func TestApplyConfigChangesHarvests(t *testing.T) {
+	srv := gorelictest.NewServer()
+	defer srv.Close()
+	agent, clock, _ := newReloadAgent()
+	srv.Configure(agent)
+	if err := agent.Run(); err != nil {
+		t.Fatal(err)
+	}
+	srv.WaitForHarvest(t, 5*time.Second)
+	if !clock.WaitForTimers(3, 5*time.Second) {
+		t.Fatalf("got %d timers, want 3", clock.Timers())
+	}
+
+	report := agent.ApplyConfig(loadConfig(t, "poll_interval: 10\nlicense: reloaded\n"))
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the harvest loop wakes up and waits for the new interval
+	if !clock.WaitForTimers(3, 5*time.Second) {
+		t.Fatalf("got %d timers, want 3", clock.Timers())
+	}
+	clock.Advance(10 * time.Second)
+	h := srv.WaitForHarvest(t, 5*time.Second)
+	if d := h.Payload.Components[0].Duration; d != 10 {
+		t.Errorf("harvest duration = %d, want 10", d)
+	}
+	if key := h.Header.Get("X-License-Key"); key != "reloaded" {
+		t.Errorf("license header = %q, want the reloaded license", key)
+	}
+}
+
+func TestReload(t *testing.T) {
+	agent, _, _ := newReloadAgent()
+	path := filepath.Join(t.TempDir(), "agent.toml")
+	writeConfig(t, path, "license = \"file\"\ngc_poll_interval = 5\nmemory_poll_interval = 5\n")
+	t.Setenv("GORELIC_MEMORY_POLL_INTERVAL", "7")
+
+	report := agent.Reload(path)
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if agent.NewrelicLicense != "file" || agent.GCPollInterval != 5 || agent.MemoryAllocatorPollInterval != 7 {
+		t.Errorf("license %q, GC interval %d, memory interval %d", agent.NewrelicLicense, agent.GCPollInterval,
+			agent.MemoryAllocatorPollInterval)
+	}
+
+	report = agent.Reload(filepath.Join(t.TempDir(), "missing.toml"))
+	if len(report.Errors) != 1 || !os.IsNotExist(report.Errors[0]) {
+		t.Errorf("errors = %v, want the missing file", report.Errors)
+	}
+	if agent.MemoryAllocatorPollInterval != 7 {
+		t.Errorf("memory interval = %d, want 7 from the environment", agent.MemoryAllocatorPollInterval)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	agent, _, logs := newReloadAgent()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig(t, path, "license: abc\n")
+
+	stop := agent.ReloadOnSignal(path, syscall.SIGUSR1)
+	for i := 1; i <= 2; i++ {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		logs.waitFor(t, "configuration applied", i)
+	}
+	stop()
+	stop()
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	agent, clock, logs := newReloadAgent()
+	path := filepath.Join(t.TempDir(), "agent.yaml")
+	writeConfig(t, path, "license: abc\n")
+
+	stop := agent.WatchConfigFile(path, time.Second)
+	defer stop()
+	tick := func() {
+		t.Helper()
+		if !clock.WaitForTimers(1, 5*time.Second) {
+			t.Fatal("the watcher is not waiting for the clock")
+		}
+		clock.Advance(time.Second)
+	}
+
+	// unchanged file
+	tick()
+	tick()
+	if n := logs.count("configuration applied"); n != 0 {
+		t.Fatalf("reloaded %d times without changes", n)
+	}
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	logs.waitFor(t, "configuration applied", 1)
+
+	tick()
+	if n := logs.count("configuration applied"); n != 1 {
+		t.Errorf("reloaded %d times, want once per change", n)
+	}
+
+	stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the watcher did not stop its timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,555 @@
+package gorelic
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+// ReservoirKind selects how a timer or histogram samples its values.
+type ReservoirKind uint8
+
+const (
+	// ExpDecayReservoir keeps a sample biased towards the last 5 minutes. It is
+	// what metrics.NewTimer uses.
+	ExpDecayReservoir ReservoirKind = iota
+	// UniformReservoir keeps a uniform random sample of all values.
+	UniformReservoir
+	// SlidingWindowReservoir keeps values of the last Window only, so
+	// percentiles describe the harvest interval.
+	SlidingWindowReservoir
+	// HDRReservoir counts all values in logarithmic buckets, so percentiles have
+	// a bounded relative error whatever the rate of updates.
+	HDRReservoir
+	// IntervalReservoir counts values like HDRReservoir, but timer and
+	// histogram metricas report only values of the last harvest interval and
+	// start over after a successful send. Rates of timers are not affected.
+	IntervalReservoir
+)
+
+const (
+	// DefaultReservoirSize - how many values exp-decay, uniform and sliding window reservoirs keep.
+	DefaultReservoirSize = 1028
+	// DefaultReservoirAlpha - how fast the exp-decay reservoir forgets values.
+	DefaultReservoirAlpha = 0.015
+	// DefaultSignificantDigits - precision of the HDR reservoir: 2 digits is at most 1% error.
+	DefaultSignificantDigits = 2
+)
+
+// Reservoir describes the sample of a timer or histogram. Zero values of the
+// fields mean defaults.
+type Reservoir struct {
+	Kind ReservoirKind
+	// Size is the number of values kept by exp-decay, uniform and sliding
+	// window reservoirs. Once a sliding window is full, the oldest values are dropped.
+	Size int
+	// Alpha is the decay factor of the exp-decay reservoir.
+	Alpha float64
+	// Window is the length of the sliding window. Reservoirs created by the
+	// agent default to its NewrelicPollInterval.
+	Window time.Duration
+	// SignificantDigits is the precision of HDR and interval reservoirs (1 to 5).
+	SignificantDigits int
+}
+
+// NewSample creates a go-metrics sample for r. clock drives sliding windows,
+// nil means SystemClock.
+func NewSample(r Reservoir, clock Clock) metrics.Sample {
+	window := r.Window
+	if window <= 0 {
+		window = DefaultNewRelicPollInterval * time.Second
+	}
+	return newSample(r, clock, func() time.Duration { return window })
+}
+
+func newSample(r Reservoir, clock Clock, window func() time.Duration) metrics.Sample {
+	size := r.Size
+	if size <= 0 {
+		size = DefaultReservoirSize
+	}
+
+	switch r.Kind {
+	case UniformReservoir:
+		return metrics.NewUniformSample(size)
+	case SlidingWindowReservoir:
+		if clock == nil {
+			clock = SystemClock
+		}
+		return newWindowSample(size, clock, window)
+	case HDRReservoir:
+		return newHDRSample(r.SignificantDigits)
+	case IntervalReservoir:
+		return newIntervalSample(r.SignificantDigits)
+	}
+
+	alpha := r.Alpha
+	if alpha <= 0 {
+		alpha = DefaultReservoirAlpha
+	}
+	return metrics.NewExpDecaySample(size, alpha)
+}
+
+// NewTimerWithReservoir creates a timer sampling durations with r.
+func NewTimerWithReservoir(r Reservoir, clock Clock) metrics.Timer {
+	return newTimerWithSample(NewSample(r, clock))
+}
+
+// newSample creates a sample for r with sliding windows following the poll interval.
+func (agent *Agent) newSample(r Reservoir) metrics.Sample {
+	return newSample(r, clockOf(agent.dataSource), func() time.Duration {
+		if r.Window > 0 {
+			return r.Window
+		}
+		if interval := agent.settings.harvestInterval(); interval > 0 {
+			return interval
+		}
+		return time.Duration(agent.NewrelicPollInterval) * time.Second
+	})
+}
+
+func (agent *Agent) newTimer(r Reservoir) metrics.Timer {
+	return newTimerWithSample(agent.newSample(r))
+}
+
+// newHistogram creates a histogram of s. Samples of this package get a
+// sampleHistogram: go-metrics histograms only snapshot samples into a
+// SampleSnapshot, whose Count is the number of values kept.
+func newHistogram(s metrics.Sample) metrics.Histogram {
+	switch s.(type) {
+	case *hdrSample, *intervalSample, *windowSample:
+		return sampleHistogram{metrics.NewHistogram(s)}
+	}
+	return metrics.NewHistogram(s)
+}
+
+// sampleHistogram is a histogram whose snapshot keeps the snapshot of its
+// sample, with the real count, min, max and sum.
+type sampleHistogram struct {
+	metrics.Histogram
+}
+
+func (h sampleHistogram) Snapshot() metrics.Histogram {
+	return histogramSnapshot{h.Sample().Snapshot()}
+}
+
+// histogramSnapshot is a read-only histogram of a sample snapshot.
+type histogramSnapshot struct {
+	sample metrics.Sample
+}
+
+func (h histogramSnapshot) Clear()                             { panic("Clear called on a snapshot") }
+func (h histogramSnapshot) Count() int64                       { return h.sample.Count() }
+func (h histogramSnapshot) Max() int64                         { return h.sample.Max() }
+func (h histogramSnapshot) Mean() float64                      { return h.sample.Mean() }
+func (h histogramSnapshot) Min() int64                         { return h.sample.Min() }
+func (h histogramSnapshot) Percentile(p float64) float64       { return h.sample.Percentile(p) }
+func (h histogramSnapshot) Percentiles(ps []float64) []float64 { return h.sample.Percentiles(ps) }
+func (h histogramSnapshot) Sample() metrics.Sample             { return h.sample }
+func (h histogramSnapshot) Snapshot() metrics.Histogram        { return h }
+func (h histogramSnapshot) StdDev() float64                    { return h.sample.StdDev() }
+func (h histogramSnapshot) Sum() int64                         { return h.sample.Sum() }
+func (h histogramSnapshot) Update(int64)                       { panic("Update called on a snapshot") }
+func (h histogramSnapshot) Variance() float64                  { return h.sample.Variance() }
+
+// sampleTimer is a timer of a sampleHistogram. go-metrics timers only
+// snapshot go-metrics histograms.
+type sampleTimer struct {
+	metrics.Timer
+	histogram metrics.Histogram
+	meter     metrics.Meter
+}
+
+func (t sampleTimer) Snapshot() metrics.Timer {
+	return timerSnapshot{t.histogram.Snapshot(), t.meter.Snapshot()}
+}
+
+// timerSnapshot is a read-only timer of histogram and meter snapshots.
+type timerSnapshot struct {
+	histogram metrics.Histogram
+	meter     metrics.Meter
+}
+
+func (t timerSnapshot) Count() int64                       { return t.histogram.Count() }
+func (t timerSnapshot) Max() int64                         { return t.histogram.Max() }
+func (t timerSnapshot) Mean() float64                      { return t.histogram.Mean() }
+func (t timerSnapshot) Min() int64                         { return t.histogram.Min() }
+func (t timerSnapshot) Percentile(p float64) float64       { return t.histogram.Percentile(p) }
+func (t timerSnapshot) Percentiles(ps []float64) []float64 { return t.histogram.Percentiles(ps) }
+func (t timerSnapshot) Rate1() float64                     { return t.meter.Rate1() }
+func (t timerSnapshot) Rate5() float64                     { return t.meter.Rate5() }
+func (t timerSnapshot) Rate15() float64                    { return t.meter.Rate15() }
+func (t timerSnapshot) RateMean() float64                  { return t.meter.RateMean() }
+func (t timerSnapshot) Snapshot() metrics.Timer            { return t }
+func (t timerSnapshot) StdDev() float64                    { return t.histogram.StdDev() }
+func (t timerSnapshot) Sum() int64                         { return t.histogram.Sum() }
+func (t timerSnapshot) Time(func())                        { panic("Time called on a snapshot") }
+func (t timerSnapshot) Update(time.Duration)               { panic("Update called on a snapshot") }
+func (t timerSnapshot) UpdateSince(time.Time)              { panic("UpdateSince called on a snapshot") }
+func (t timerSnapshot) Variance() float64                  { return t.histogram.Variance() }
+
+// valuesSample is a read-only sample of fixed values.
+type valuesSample struct {
+	count  int64
+	values []int64
+}
+
+func (s *valuesSample) Clear()                       { panic("Clear called on a snapshot") }
+func (s *valuesSample) Count() int64                 { return s.count }
+func (s *valuesSample) Max() int64                   { return metrics.SampleMax(s.values) }
+func (s *valuesSample) Mean() float64                { return metrics.SampleMean(s.values) }
+func (s *valuesSample) Min() int64                   { return metrics.SampleMin(s.values) }
+func (s *valuesSample) Percentile(p float64) float64 { return metrics.SamplePercentile(s.values, p) }
+func (s *valuesSample) Percentiles(ps []float64) []float64 {
+	return metrics.SamplePercentiles(s.values, ps)
+}
+func (s *valuesSample) Size() int                { return len(s.values) }
+func (s *valuesSample) Snapshot() metrics.Sample { return s }
+func (s *valuesSample) StdDev() float64          { return metrics.SampleStdDev(s.values) }
+func (s *valuesSample) Sum() int64               { return metrics.SampleSum(s.values) }
+func (s *valuesSample) Update(int64)             { panic("Update called on a snapshot") }
+func (s *valuesSample) Values() []int64          { return append([]int64(nil), s.values...) }
+func (s *valuesSample) Variance() float64        { return metrics.SampleVariance(s.values) }
+
+// windowSample keeps the values updated within the last window, at most size
+// of them. times and values form a ring buffer holding n values from head on,
+// grown up to size as needed, so updates take constant time.
+type windowSample struct {
+	clock  Clock
+	window func() time.Duration
+	size   int
+
+	lk     sync.Mutex
+	count  int64
+	head   int
+	n      int
+	times  []time.Time
+	values []int64
+}
+
+func newWindowSample(size int, clock Clock, window func() time.Duration) *windowSample {
+	if size < 1 {
+		size = 1
+	}
+	return &windowSample{clock: clock, window: window, size: size}
+}
+
+// expire drops values older than the window. It must be called with s.lk held.
+func (s *windowSample) expire() {
+	since := s.clock.Now().Add(-s.window())
+	for s.n > 0 && !s.times[s.head].After(since) {
+		s.head = (s.head + 1) % len(s.values)
+		s.n--
+	}
+}
+
+// grow makes room for more values, up to size. It must be called with s.lk
+// held.
+func (s *windowSample) grow() {
+	size := 2 * len(s.values)
+	if size < 16 {
+		size = 16
+	}
+	if size > s.size {
+		size = s.size
+	}
+
+	times, values := make([]time.Time, size), make([]int64, size)
+	for i := 0; i < s.n; i++ {
+		j := (s.head + i) % len(s.values)
+		times[i], values[i] = s.times[j], s.values[j]
+	}
+	s.head, s.times, s.values = 0, times, values
+}
+
+func (s *windowSample) Clear() {
+	s.lk.Lock()
+	s.count, s.head, s.n = 0, 0, 0
+	s.lk.Unlock()
+}
+
+func (s *windowSample) Update(v int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.count++
+	if s.n == len(s.values) {
+		if s.n < s.size {
+			s.grow()
+		} else {
+			// full, the oldest value makes room
+			s.head = (s.head + 1) % len(s.values)
+			s.n--
+		}
+	}
+	i := (s.head + s.n) % len(s.values)
+	s.times[i], s.values[i] = s.clock.Now(), v
+	s.n++
+}
+
+// snapshot returns the values within the window, oldest first.
+func (s *windowSample) snapshot() *valuesSample {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.expire()
+	values := make([]int64, s.n)
+	for i := range values {
+		values[i] = s.values[(s.head+i)%len(s.values)]
+	}
+	return &valuesSample{s.count, values}
+}
+
+func (s *windowSample) Snapshot() metrics.Sample {
+	return s.snapshot()
+}
+
+func (s *windowSample) Count() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.count
+}
+
+func (s *windowSample) Values() []int64                    { return s.snapshot().Values() }
+func (s *windowSample) Size() int                          { return s.snapshot().Size() }
+func (s *windowSample) Max() int64                         { return s.snapshot().Max() }
+func (s *windowSample) Mean() float64                      { return s.snapshot().Mean() }
+func (s *windowSample) Min() int64                         { return s.snapshot().Min() }
+func (s *windowSample) Percentile(p float64) float64       { return s.snapshot().Percentile(p) }
+func (s *windowSample) Percentiles(ps []float64) []float64 { return s.snapshot().Percentiles(ps) }
+func (s *windowSample) StdDev() float64                    { return s.snapshot().StdDev() }
+func (s *windowSample) Sum() int64                         { return s.snapshot().Sum() }
+func (s *windowSample) Variance() float64                  { return s.snapshot().Variance() }
+
+// hdrSample counts values in buckets growing by a constant ratio, so every
+// value is represented with a relative error below 10^-digits. Count, Min,
+// Max, Sum and Mean are exact.
+type hdrSample struct {
+	base    float64
+	logBase float64
+
+	lk      sync.Mutex
+	buckets map[int]int64
+	count   int64
+	sum     int64
+	sumSq   float64
+	min     int64
+	max     int64
+}
+
+func newHDRSample(digits int) *hdrSample {
+	if digits <= 0 {
+		digits = DefaultSignificantDigits
+	}
+	if digits > 5 {
+		digits = 5
+	}
+	// a bucket [b^i, b^(i+1)) is represented by its middle, which is at most
+	// (b-1)/2 away from any value in it.
+	base := 1 + 2*math.Pow(10, -float64(digits))
+	return &hdrSample{base: base, logBase: math.Log(base), buckets: make(map[int]int64)}
+}
+
+// zeroBucket holds zero and negative values.
+const zeroBucket = math.MinInt32
+
+func (s *hdrSample) bucket(v int64) int {
+	if v <= 0 {
+		return zeroBucket
+	}
+	return int(math.Floor(math.Log(float64(v)) / s.logBase))
+}
+
+// value returns the value representing bucket i. It must be called with s.lk held.
+func (s *hdrSample) value(i int) int64 {
+	if i == zeroBucket {
+		if s.min < 0 {
+			return s.min
+		}
+		return 0
+	}
+	v := int64(math.Round(math.Pow(s.base, float64(i)) * (1 + s.base) / 2))
+	if v < s.min {
+		return s.min
+	}
+	if v > s.max {
+		return s.max
+	}
+	return v
+}
+
+// sorted returns the non-empty buckets in increasing order. It must be called with s.lk held.
+func (s *hdrSample) sorted() []int {
+	keys := make([]int, 0, len(s.buckets))
+	for k := range s.buckets {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func (s *hdrSample) Clear() {
+	s.lk.Lock()
+	s.buckets = make(map[int]int64)
+	s.count, s.sum, s.sumSq, s.min, s.max = 0, 0, 0, 0, 0
+	s.lk.Unlock()
+}
+
+func (s *hdrSample) Update(v int64) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+	s.sumSq += float64(v) * float64(v)
+	s.buckets[s.bucket(v)]++
+}
+
+func (s *hdrSample) Count() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.count
+}
+
+// Size returns the number of buckets in use, which is bounded by the range of
+// values and the precision, not by their count.
+func (s *hdrSample) Size() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return len(s.buckets)
+}
+
+func (s *hdrSample) Max() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.max
+}
+
+func (s *hdrSample) Min() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.min
+}
+
+func (s *hdrSample) Sum() int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.sum
+}
+
+func (s *hdrSample) Mean() float64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.count == 0 {
+		return 0
+	}
+	return float64(s.sum) / float64(s.count)
+}
+
+func (s *hdrSample) Variance() float64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.count == 0 {
+		return 0
+	}
+	mean := float64(s.sum) / float64(s.count)
+	return s.sumSq/float64(s.count) - mean*mean
+}
+
+func (s *hdrSample) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+func (s *hdrSample) Percentile(p float64) float64 {
+	return s.Percentiles([]float64{p})[0]
+}
+
+func (s *hdrSample) Percentiles(ps []float64) []float64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	scores := make([]float64, len(ps))
+	if s.count == 0 {
+		return scores
+	}
+	keys := s.sorted()
+	for i, p := range ps {
+		rank := int64(math.Ceil(p * float64(s.count)))
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for _, k := range keys {
+			seen += s.buckets[k]
+			if seen >= rank {
+				scores[i] = float64(s.value(k))
+				break
+			}
+		}
+	}
+	return scores
+}
+
+// Values returns the value representing each bucket in use, in increasing
+// order. Values are not repeated by their count, so memory stays bounded.
+func (s *hdrSample) Values() []int64 {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	keys := s.sorted()
+	values := make([]int64, len(keys))
+	for i, k := range keys {
+		values[i] = s.value(k)
+	}
+	return values
+}
+
+// merge adds the values of other to s.
+func (s *hdrSample) merge(other *hdrSample) {
+	other.lk.Lock()
+	defer other.lk.Unlock()
+	if other.count == 0 {
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || other.max > s.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.sum += other.sum
+	s.sumSq += other.sumSq
+	for k, n := range other.buckets {
+		s.buckets[k] += n
+	}
+}
+
+// Snapshot returns a read-only copy of s with the same count, min, max, sum
+// and buckets.
+func (s *hdrSample) Snapshot() metrics.Sample {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	c := &hdrSample{base: s.base, logBase: s.logBase, buckets: make(map[int]int64, len(s.buckets)),
+		count: s.count, sum: s.sum, sumSq: s.sumSq, min: s.min, max: s.max}
+	for k, n := range s.buckets {
+		c.buckets[k] = n
+	}
+	return hdrSnapshot{c}
+}
+
+// hdrSnapshot is a read-only hdrSample.
+type hdrSnapshot struct {
+	*hdrSample
+}
+
+func (s hdrSnapshot) Clear()                   { panic("Clear called on a snapshot") }
+func (s hdrSnapshot) Update(int64)             { panic("Update called on a snapshot") }
+func (s hdrSnapshot) Snapshot() metrics.Sample { return s }
@@ -0,0 +1,139 @@
+package gorelic
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+func TestWindowSample(t *testing.T) {
+	clock := &sleepClock{now: time.Unix(0, 0)}
+	s := newWindowSample(40, clock, func() time.Duration { return time.Minute })
+
+	values := func(want ...int64) {
+		t.Helper()
+		if got := s.Values(); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+			t.Errorf("Values() = %v, want %v", got, want)
+		}
+	}
+
+	// the ring grows, then wraps around keeping the last 40 values in order
+	var want []int64
+	for i := int64(1); i <= 100; i++ {
+		s.Update(i)
+		want = append(want, i)
+	}
+	values(want[60:]...)
+	if s.Count() != 100 {
+		t.Errorf("Count() = %d, want 100", s.Count())
+	}
+
+	// values leave the window in the order they came
+	clock.now = clock.now.Add(30 * time.Second)
+	s.Update(101)
+	s.Update(102)
+	clock.now = clock.now.Add(40 * time.Second)
+	values(101, 102)
+	s.Update(103)
+	values(101, 102, 103)
+	clock.now = clock.now.Add(time.Minute)
+	values()
+	s.Update(104)
+	values(104)
+	if s.Max() != 104 || s.Min() != 104 {
+		t.Errorf("Max(), Min() = %d, %d, want 104", s.Max(), s.Min())
+	}
+
+	s.Clear()
+	values()
+	if s.Count() != 0 {
+		t.Errorf("Count() = %d after Clear, want 0", s.Count())
+	}
+	for i := int64(1); i <= 50; i++ {
+		s.Update(i)
+	}
+	values(want[10:50]...)
+}
+
+func TestHDRSampleBounded(t *testing.T) {
+	s := newHDRSample(2)
+	for i := int64(1); i <= 100000; i++ {
+		s.Update(i % 1000)
+	}
+
+	values := s.Values()
+	if len(values) != s.Size() || s.Size() > 400 {
+		t.Errorf("got %d values, Size() = %d, want one per bucket", len(values), s.Size())
+	}
+	if !sort.SliceIsSorted(values, func(i, j int) bool { return values[i] < values[j] }) {
+		t.Errorf("Values() are not sorted: %v", values)
+	}
+	// buckets are represented by their middle, within 1% at 2 digits
+	if last := values[len(values)-1]; values[0] != 0 || last < 990 || last > 999 {
+		t.Errorf("Values() span %d to %d, want 0 to about 999", values[0], last)
+	}
+}
+
+func TestSampleSnapshots(t *testing.T) {
+	clock := &sleepClock{now: time.Unix(0, 0)}
+	for _, kind := range []ReservoirKind{HDRReservoir, IntervalReservoir, SlidingWindowReservoir} {
+		r := Reservoir{Kind: kind, Size: 100}
+		timer := NewTimerWithReservoir(r, clock)
+		histogram := newHistogram(NewSample(r, clock))
+		for i := 1; i <= 5000; i++ {
+			timer.Update(time.Duration(i))
+			histogram.Update(int64(i))
+		}
+		if kind == IntervalReservoir {
+			// values of the closed interval are reported
+			intervalOf(timer).rotate(1)
+			intervalOf(histogram).rotate(1)
+		}
+
+		timerSnapshot, histogramSnapshot := timer.Snapshot(), histogram.Snapshot()
+		timer.Update(time.Hour)
+		histogram.Update(1 << 40)
+
+		for name, h := range map[string]interface {
+			Count() int64
+			Min() int64
+			Max() int64
+			Sum() int64
+			Percentile(float64) float64
+		}{"timer": timerSnapshot, "histogram": histogramSnapshot} {
+			if h.Count() != 5000 {
+				t.Errorf("%v %s: snapshot Count() = %d, want 5000", kind, name, h.Count())
+			}
+			if kind == SlidingWindowReservoir {
+				// the window keeps the last Size values
+				if h.Min() != 4901 || h.Max() != 5000 {
+					t.Errorf("%v %s: snapshot spans %d to %d, want 4901 to 5000", kind, name, h.Min(), h.Max())
+				}
+				continue
+			}
+			if h.Min() != 1 || h.Max() != 5000 || h.Sum() != 5000*5001/2 {
+				t.Errorf("%v %s: snapshot min %d, max %d, sum %d", kind, name, h.Min(), h.Max(), h.Sum())
+			}
+			if p := h.Percentile(0.5); math.Abs(p-2500) > 2500*0.01 {
+				t.Errorf("%v %s: snapshot median %v, want about 2500", kind, name, p)
+			}
+		}
+	}
+
+	// go-metrics snapshots of other samples are unchanged
+	if _, ok := newHistogram(metrics.NewUniformSample(10)).Snapshot().(*metrics.HistogramSnapshot); !ok {
+		t.Error("histograms of go-metrics samples do not use go-metrics snapshots")
+	}
+}
+
+func BenchmarkWindowSampleUpdate(b *testing.B) {
+	s := newWindowSample(DefaultReservoirSize, SystemClock, func() time.Duration { return time.Minute })
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.Update(int64(i))
+	}
+}
@@ -0,0 +1,251 @@
+package gorelic
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// used by proxyWrapper to record http statuses, response sizes and Apdex
+type statusRecorder struct {
+	http.ResponseWriter
+	agent       *Agent
+	wroteHeader bool
+	statuses    bool
+	status      int
+	written     int64
+	hijacked    bool
+
+	// views caches the writers returned by wrap, one per set of optional
+	// interfaces, as recorders are reused
+	views [16]http.ResponseWriter
+}
+
+var statusRecorders = sync.Pool{New: func() interface{} { return new(statusRecorder) }}
+
+// getStatusRecorder returns a recorder of w from the pool. It must be put back
+// with putStatusRecorder once the handler has returned.
+func getStatusRecorder(w http.ResponseWriter, agent *Agent, statuses bool) *statusRecorder {
+	sr := statusRecorders.Get().(*statusRecorder)
+	sr.ResponseWriter = w
+	sr.agent = agent
+	sr.statuses = statuses
+	return sr
+}
+
+func putStatusRecorder(sr *statusRecorder) {
+	views := sr.views
+	*sr = statusRecorder{views: views}
+	statusRecorders.Put(sr)
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.recordStatus(status)
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// recordStatus records status as written, without writing it.
+func (sr *statusRecorder) recordStatus(status int) {
+	if !sr.wroteHeader {
+		sr.status = status
+	}
+	sr.wroteHeader = true
+	if sr.statuses {
+		sr.agent.httpStatuses.record(status)
+	}
+}
+
+// failStatus records the response as a 500, even if the handler wrote another
+// status before it panicked: the server aborts the response then, so the
+// client gets a truncated one.
+func (sr *statusRecorder) failStatus() {
+	if !sr.wroteHeader {
+		sr.recordStatus(http.StatusInternalServerError)
+		return
+	}
+	if sr.status == http.StatusInternalServerError {
+		return
+	}
+	if sr.statuses {
+		sr.agent.httpStatuses.replace(sr.status, http.StatusInternalServerError)
+	}
+	sr.status = http.StatusInternalServerError
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if !sr.wroteHeader {
+		sr.WriteHeader(http.StatusOK)
+	}
+
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Flush() {
+	if !sr.wroteHeader {
+		sr.WriteHeader(http.StatusOK)
+	}
+	sr.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack counts hijacked connections. Their status is not recorded, as the
+// response is written to the connection directly.
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := sr.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		sr.hijacked = true
+		sr.agent.dataSource.IncCounterForKey(httpHijackedDataSourceKey, 1)
+	}
+	return conn, rw, err
+}
+
+func (sr *statusRecorder) Push(target string, opts *http.PushOptions) error {
+	return sr.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+// ReadFrom keeps sendfile working for responses served from files.
+func (sr *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if !sr.wroteHeader {
+		sr.WriteHeader(http.StatusOK)
+	}
+
+	n, err := sr.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	sr.written += n
+	return n, err
+}
+
+// recorder is the part of statusRecorder every wrapped writer has.
+type recorder interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+}
+
+// wrap returns sr as a writer implementing exactly the optional interfaces
+// (http.Flusher, http.Hijacker, http.Pusher, io.ReaderFrom) of the original
+// one, so handlers checking for them behave as if they were not wrapped.
+func (sr *statusRecorder) wrap() http.ResponseWriter {
+	var which int
+	if _, ok := sr.ResponseWriter.(http.Flusher); ok {
+		which |= 1
+	}
+	if _, ok := sr.ResponseWriter.(http.Hijacker); ok {
+		which |= 2
+	}
+	if _, ok := sr.ResponseWriter.(http.Pusher); ok {
+		which |= 4
+	}
+	if _, ok := sr.ResponseWriter.(io.ReaderFrom); ok {
+		which |= 8
+	}
+
+	if sr.views[which] == nil {
+		sr.views[which] = sr.view(which)
+	}
+	return sr.views[which]
+}
+
+func (sr *statusRecorder) view(which int) http.ResponseWriter {
+	switch which {
+	case 1:
+		return struct {
+			recorder
+			http.Flusher
+		}{sr, sr}
+	case 2:
+		return struct {
+			recorder
+			http.Hijacker
+		}{sr, sr}
+	case 1 | 2:
+		return struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+		}{sr, sr, sr}
+	case 4:
+		return struct {
+			recorder
+			http.Pusher
+		}{sr, sr}
+	case 1 | 4:
+		return struct {
+			recorder
+			http.Flusher
+			http.Pusher
+		}{sr, sr, sr}
+	case 2 | 4:
+		return struct {
+			recorder
+			http.Hijacker
+			http.Pusher
+		}{sr, sr, sr}
+	case 1 | 2 | 4:
+		return struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{sr, sr, sr, sr}
+	case 8:
+		return struct {
+			recorder
+			io.ReaderFrom
+		}{sr, sr}
+	case 1 | 8:
+		return struct {
+			recorder
+			http.Flusher
+			io.ReaderFrom
+		}{sr, sr, sr}
+	case 2 | 8:
+		return struct {
+			recorder
+			http.Hijacker
+			io.ReaderFrom
+		}{sr, sr, sr}
+	case 1 | 2 | 8:
+		return struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{sr, sr, sr, sr}
+	case 4 | 8:
+		return struct {
+			recorder
+			http.Pusher
+			io.ReaderFrom
+		}{sr, sr, sr}
+	case 1 | 4 | 8:
+		return struct {
+			recorder
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{sr, sr, sr, sr}
+	case 2 | 4 | 8:
+		return struct {
+			recorder
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{sr, sr, sr, sr}
+	case 1 | 2 | 4 | 8:
+		return struct {
+			recorder
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{sr, sr, sr, sr, sr}
+	}
+	return struct{ recorder }{sr}
+}
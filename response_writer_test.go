@@ -0,0 +1,177 @@
+package gorelic
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fullWriter implements every optional interface and records calls to them.
+type fullWriter struct {
+	httptest.ResponseRecorder
+	calls []string
+}
+
+func newFullWriter() *fullWriter {
+	return &fullWriter{ResponseRecorder: *httptest.NewRecorder()}
+}
+
+func (w *fullWriter) Flush() {
+	w.calls = append(w.calls, "Flush")
+	w.ResponseRecorder.Flush()
+}
+
+func (w *fullWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.calls = append(w.calls, "Hijack")
+	server, client := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func (w *fullWriter) Push(target string, opts *http.PushOptions) error {
+	w.calls = append(w.calls, "Push")
+	return nil
+}
+
+func (w *fullWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.calls = append(w.calls, "ReadFrom")
+	return io.Copy(&w.ResponseRecorder, r)
+}
+
+// optionalInterfaces returns the set of optional interfaces of w, as in
+// statusRecorder.wrap.
+func optionalInterfaces(w http.ResponseWriter) int {
+	var which int
+	if _, ok := w.(http.Flusher); ok {
+		which |= 1
+	}
+	if _, ok := w.(http.Hijacker); ok {
+		which |= 2
+	}
+	if _, ok := w.(http.Pusher); ok {
+		which |= 4
+	}
+	if _, ok := w.(io.ReaderFrom); ok {
+		which |= 8
+	}
+	return which
+}
+
+func TestStatusRecorderViews(t *testing.T) {
+	agent := newTestAgent(t)
+	agent.initTimer()
+	for which := 0; which < 16; which++ {
+		full := newFullWriter()
+		// a view of a recorder around full is a writer with exactly the
+		// interfaces in which, all reaching full
+		w := (&statusRecorder{ResponseWriter: full, agent: agent}).view(which)
+		if got := optionalInterfaces(w); got != which {
+			t.Fatalf("view(%04b) implements %04b", which, got)
+		}
+
+		sr := getStatusRecorder(w, agent, false)
+		wrapped := sr.wrap()
+		if got := optionalInterfaces(wrapped); got != which {
+			t.Errorf("writer implementing %04b is wrapped as %04b", which, got)
+		}
+		if u, ok := wrapped.(interface{ Unwrap() http.ResponseWriter }); !ok || u.Unwrap() != w {
+			t.Errorf("%04b: http.ResponseController can not reach the original writer", which)
+		}
+
+		var want []string
+		if f, ok := wrapped.(http.Flusher); ok {
+			f.Flush()
+			want = append(want, "Flush")
+		}
+		if p, ok := wrapped.(http.Pusher); ok {
+			p.Push("/style.css", nil)
+			want = append(want, "Push")
+		}
+		if r, ok := wrapped.(io.ReaderFrom); ok {
+			r.ReadFrom(strings.NewReader("body"))
+			want = append(want, "ReadFrom")
+		}
+		if h, ok := wrapped.(http.Hijacker); ok {
+			conn, _, err := h.Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			want = append(want, "Hijack")
+		}
+		if strings.Join(full.calls, ",") != strings.Join(want, ",") {
+			t.Errorf("%04b: original writer got %v, want %v", which, full.calls, want)
+		}
+		if which&1 != 0 && !full.Flushed {
+			t.Errorf("%04b: Flush was not passed on", which)
+		}
+		if which&(1|8) != 0 && (!sr.wroteHeader || sr.status != http.StatusOK) {
+			t.Errorf("%04b: status %d recorded %v, want 200 written by Flush or ReadFrom", which, sr.status, sr.wroteHeader)
+		}
+		if which&8 != 0 && sr.written != int64(len("body")) {
+			t.Errorf("%04b: %d bytes counted by ReadFrom, want 4", which, sr.written)
+		}
+		if sr.hijacked != (which&2 != 0) {
+			t.Errorf("%04b: hijacked = %v", which, sr.hijacked)
+		}
+		putStatusRecorder(sr)
+	}
+}
+
+func TestStatusRecorderReuse(t *testing.T) {
+	agent := newTestAgent(t)
+	sr := getStatusRecorder(newFullWriter(), agent, false)
+	sr.WriteHeader(http.StatusTeapot)
+	sr.Write([]byte("tea"))
+	first := sr.wrap()
+	putStatusRecorder(sr)
+
+	if sr.wroteHeader || sr.status != 0 || sr.written != 0 || sr.hijacked || sr.ResponseWriter != nil {
+		t.Errorf("recorder state was kept when put back: %+v", sr)
+	}
+	sr.ResponseWriter = newFullWriter()
+	if sr.wrap() != first {
+		t.Error("the view of a reused recorder was allocated again")
+	}
+}
+
+func TestHijackedConnections(t *testing.T) {
+	agent := newTestAgent(t)
+	agent.CollectHTTPStatuses = true
+	agent.ApdexThreshold = time.Second
+	agent.SlowRequestThreshold = time.Nanosecond
+	h := agent.WrapHTTPHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		time.Sleep(time.Millisecond)
+	})
+	agent.settings.sync(agent)
+	h(newFullWriter(), httptest.NewRequest("GET", "/ws", nil))
+
+	if got := counterValue(t, agent.dataSource, httpHijackedDataSourceKey); got != 1 {
+		t.Errorf("hijacked = %v, want 1", got)
+	}
+	// the response is written to the connection, the wrapper sees no status
+	for _, class := range httpStatusClasses {
+		if got := counterValue(t, agent.dataSource, httpStatusClassDataSourceKey+class); got != 0 {
+			t.Errorf("%s = %v, want 0 for a hijacked connection", class, got)
+		}
+	}
+	// nor is the lifetime of the connection a response time
+	for zone := range apdexZones {
+		if got := counterValue(t, agent.dataSource, agent.httpApdex.all.zoneKey(zone)); got != 0 {
+			t.Errorf("Apdex %s = %v, want 0 for a hijacked connection", apdexZones[zone], got)
+		}
+	}
+	if slow := agent.SlowRequests(); len(slow) != 0 {
+		t.Errorf("hijacked connection logged as slow: %+v", slow)
+	}
+}
@@ -0,0 +1,239 @@
+package gorelic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// sleepClock records the delays the agent sleeps for and returns at once.
+type sleepClock struct {
+	now time.Time
+
+	lk     sync.Mutex
+	sleeps []time.Duration
+}
+
+func (c *sleepClock) Now() time.Time {
+	return c.now
+}
+
+func (c *sleepClock) NewTimer(d time.Duration) ClockTimer {
+	c.lk.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.lk.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return firedTimer(ch)
+}
+
+type firedTimer chan time.Time
+
+func (t firedTimer) C() <-chan time.Time { return t }
+func (t firedTimer) Stop() bool          { return false }
+
+// flakyServer answers the n-th request with responses[n], and with 200 once
+// responses run out.
+type flakyServer struct {
+	*httptest.Server
+	responses []func(w http.ResponseWriter)
+
+	lk       sync.Mutex
+	attempts int
+}
+
+func newFlakyServer(responses ...func(w http.ResponseWriter)) *flakyServer {
+	s := &flakyServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.lk.Lock()
+		n := s.attempts
+		s.attempts++
+		s.lk.Unlock()
+
+		if n < len(s.responses) {
+			s.responses[n](w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return s
+}
+
+func (s *flakyServer) attemptCount() int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.attempts
+}
+
+func status(code int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) { w.WriteHeader(code) }
+}
+
+func retryAfter(header string, code int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", header)
+		w.WriteHeader(code)
+	}
+}
+
+// dropConnection closes the connection without a response.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Minute,
+	Multiplier:     2,
+}
+
+func newRetryTestAgent(url string, policy RetryPolicy) (*Agent, *sleepClock) {
+	clock := &sleepClock{now: time.Unix(1000, 0)}
+	agent := NewAgent()
+	agent.Clock = clock
+	agent.RetryPolicy = policy
+	agent.plugin = newrelic_platform_go.NewNewrelicPlugin(agent.AgentVersion, "license", agent.NewrelicPollInterval, agent.NewRelicFatalThreshold)
+	agent.plugin.URL = url
+	return agent, clock
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    RetryPolicy
+		responses []func(w http.ResponseWriter)
+		status    int
+		err       bool
+		attempts  int
+		sleeps    []time.Duration
+	}{
+		{
+			name:      "5xx then success",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){status(503), status(502)},
+			status:    200,
+			attempts:  3,
+			sleeps:    []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:      "429 with Retry-After in seconds",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){retryAfter("3", 429)},
+			status:    200,
+			attempts:  2,
+			sleeps:    []time.Duration{3 * time.Second},
+		},
+		{
+			name:      "503 with Retry-After as a date",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){retryAfter(time.Unix(1005, 0).UTC().Format(http.TimeFormat), 503)},
+			status:    200,
+			attempts:  2,
+			sleeps:    []time.Duration{5 * time.Second},
+		},
+		{
+			name:      "Retry-After longer than MaxBackoff",
+			policy:    RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 2 * time.Second},
+			responses: []func(w http.ResponseWriter){retryAfter("30", 429)},
+			status:    429,
+			attempts:  1,
+		},
+		{
+			name:      "4xx is not retried",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){status(400)},
+			status:    400,
+			attempts:  1,
+		},
+		{
+			name:      "403 is not retried",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){status(403)},
+			status:    403,
+			attempts:  1,
+		},
+		{
+			name:      "network error then success",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){dropConnection},
+			status:    200,
+			attempts:  2,
+			sleeps:    []time.Duration{10 * time.Millisecond},
+		},
+		{
+			name:      "MaxAttempts exhausted",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){status(500), status(500), status(500), status(500)},
+			status:    500,
+			attempts:  3,
+			sleeps:    []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:      "MaxAttempts exhausted by network errors",
+			policy:    testRetryPolicy,
+			responses: []func(w http.ResponseWriter){dropConnection, dropConnection, dropConnection},
+			err:       true,
+			attempts:  3,
+			sleeps:    []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			name:      "retries disabled",
+			policy:    RetryPolicy{MaxAttempts: 1},
+			responses: []func(w http.ResponseWriter){status(503)},
+			status:    503,
+			attempts:  1,
+		},
+		{
+			name:      "backoff capped by MaxBackoff",
+			policy:    RetryPolicy{MaxAttempts: 4, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 4},
+			responses: []func(w http.ResponseWriter){status(500), status(500), status(500)},
+			status:    200,
+			attempts:  4,
+			sleeps:    []time.Duration{time.Second, 3 * time.Second, 3 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFlakyServer(tt.responses...)
+			defer srv.Close()
+			agent, clock := newRetryTestAgent(srv.URL, tt.policy)
+
+			status, err := agent.send([]byte("{}"))
+			if status != tt.status || (err != nil) != tt.err {
+				t.Errorf("send() = %d, %v, want %d, error %v", status, err, tt.status, tt.err)
+			}
+			if attempts := srv.attemptCount(); attempts != tt.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.attempts)
+			}
+			if len(clock.sleeps) != len(tt.sleeps) {
+				t.Fatalf("slept %v, want %v", clock.sleeps, tt.sleeps)
+			}
+			for i := range tt.sleeps {
+				if clock.sleeps[i] != tt.sleeps[i] {
+					t.Errorf("slept %v, want %v", clock.sleeps, tt.sleeps)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, Multiplier: 2, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		if d := policy.backoff(2); d < 1500*time.Millisecond || d > 2500*time.Millisecond {
+			t.Fatalf("backoff(2) = %v, want 2s +/- 25%%", d)
+		}
+	}
+}
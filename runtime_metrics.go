@@ -30,9 +30,12 @@ func (metrica *noGoroutinesMetrica) ClearSentData() {
 	// no-op
 }
 
-// Number of CGO calls metrica
+// Number of CGO calls metrica. Calls are counted since the last harvest that
+// was sent, see GaugeDeltaMetrica.
 type noCgoCallsMetrica struct {
 	lastValue int64
+	readValue int64
+	read      bool
 }
 
 func (metrica *noCgoCallsMetrica) GetName() string {
@@ -44,12 +47,14 @@ func (metrica *noCgoCallsMetrica) GetUnits() string {
 func (metrica *noCgoCallsMetrica) GetValue() (float64, error) {
 	currentValue := runtime.NumCgoCall()
 	value := float64(currentValue - metrica.lastValue)
-	metrica.lastValue = currentValue
+	metrica.readValue, metrica.read = currentValue, true
 
 	return value, nil
 }
 func (metrica *noCgoCallsMetrica) ClearSentData() {
-	// no-op
+	if metrica.read {
+		metrica.lastValue, metrica.read = metrica.readValue, false
+	}
 }
 
 //OS specific metrics data source interface
@@ -58,13 +63,14 @@ type iSystemDataSource interface {
 }
 
 // iSystemDataSource fabrica
-func newSystemDataSource() iSystemDataSource {
+func newSystemDataSource(clock Clock) iSystemDataSource {
 	var ds iSystemDataSource
 	switch runtime.GOOS {
 	default:
 		ds = &systemDataSource{}
 	case "linux":
 		ds = &linuxSystemDataSource{
+			clock:      clock,
 			systemData: make(map[string]string),
 		}
 	}
@@ -80,6 +86,7 @@ func (ds *systemDataSource) GetValue(key string) (float64, error) {
 
 // Linux OS implementation of ISystemDataSource
 type linuxSystemDataSource struct {
+	clock      Clock
 	lastUpdate time.Time
 	systemData map[string]string
 }
@@ -114,7 +121,7 @@ func (ds *linuxSystemDataSource) GetValue(key string) (float64, error) {
 	}
 }
 func (ds *linuxSystemDataSource) checkAndUpdateData() error {
-	startTime := time.Now()
+	startTime := ds.clock.Now()
 	if startTime.Sub(ds.lastUpdate) > time.Second*linuxSystemQueryInterval {
 		path := fmt.Sprintf("/proc/%d/status", os.Getpid())
 		rawStats, err := ioutil.ReadFile(path)
@@ -158,11 +165,11 @@ func (metrica *systemMetrica) ClearSentData() {
 	// no-op
 }
 
-func addRuntimeMetricsToComponent(component newrelic_platform_go.IComponent) {
+func addRuntimeMetricsToComponent(component newrelic_platform_go.IComponent, clock Clock) {
 	component.AddMetrica(&noGoroutinesMetrica{})
 	component.AddMetrica(&noCgoCallsMetrica{})
 
-	ds := newSystemDataSource()
+	ds := newSystemDataSource(clock)
 	metrics := []*systemMetrica{
 		{
 			sourceKey:    "Threads",
@@ -0,0 +1,129 @@
+package gorelic
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// TimerStats selects the statistics reported for a timer. Funcs are reported
+// under their names (Max, Mean, Rate1...), and every percentile p (0 < p <= 1)
+// under PercentileName(p), e.g. 0.99 as Percentile99. TimerPercentile in Funcs
+// is ignored, use Percentiles instead. With Aggregate set, the timer is also
+// reported under basePath itself as one NewRelic aggregate metric (see
+// TimerAggregateMetrica), e.g. TimerStats{Aggregate: true} alone sends a
+// single metric per timer.
+type TimerStats struct {
+	Funcs       []TimerFunc
+	Percentiles []float64
+	Aggregate   bool
+}
+
+// HistogramStats selects the statistics reported for a histogram, the same way
+// TimerStats does for timers.
+type HistogramStats struct {
+	Funcs       []HistogramFunc
+	Percentiles []float64
+	Aggregate   bool
+}
+
+// DefaultTimerStats - statistics reported for timers unless configured otherwise.
+var DefaultTimerStats = TimerStats{
+	Funcs:       []TimerFunc{TimerMax, TimerMean, TimerMin},
+	Percentiles: []float64{0.95},
+}
+
+// DefaultHistogramStats - statistics reported for histograms unless configured otherwise.
+var DefaultHistogramStats = HistogramStats{
+	Funcs:       []HistogramFunc{HistogramMax, HistogramMean, HistogramMin},
+	Percentiles: []float64{0.95},
+}
+
+var timerFuncNames = map[TimerFunc]string{
+	TimerCount:    "Count",
+	TimerMax:      "Max",
+	TimerMean:     "Mean",
+	TimerMin:      "Min",
+	TimerRate1:    "Rate1",
+	TimerRate5:    "Rate5",
+	TimerRate15:   "Rate15",
+	TimerRateMean: "RateMean",
+	TimerStdDev:   "StdDev",
+	TimerSum:      "Sum",
+	TimerVariance: "Variance",
+}
+
+var histogramFuncNames = map[HistogramFunc]string{
+	HistogramCount:    "Count",
+	HistogramMax:      "Max",
+	HistogramMean:     "Mean",
+	HistogramMin:      "Min",
+	HistogramStdDev:   "StdDev",
+	HistogramSum:      "Sum",
+	HistogramVariance: "Variance",
+}
+
+// PercentileName returns the path segment a percentile is reported under:
+// 0.5 as Percentile50, 0.99 as Percentile99 and 0.999 as Percentile999.
+func PercentileName(p float64) string {
+	percent := strconv.FormatFloat(math.Round(p*1e6)/1e4, 'f', -1, 64)
+	return "Percentile" + strings.Replace(percent, ".", "", 1)
+}
+
+// timerFuncUnits returns units of a timer statistic. Durations are reported
+// in milliseconds, rates and counts in the units of the timer.
+func timerFuncUnits(tf TimerFunc, units string) string {
+	switch tf {
+	case TimerMax, TimerMean, TimerMin, TimerStdDev, TimerSum:
+		return "ms"
+	case TimerVariance:
+		return "ms^2"
+	}
+	return units
+}
+
+// Metricas builds the metricas of timer dataSourceKey reported under basePath.
+// units are used for counts and rates.
+func (stats TimerStats) Metricas(ds DataSource, dataSourceKey, basePath, units string) []newrelic_platform_go.IMetrica {
+	ret := make([]newrelic_platform_go.IMetrica, 0, len(stats.Funcs)+len(stats.Percentiles)+1)
+	if stats.Aggregate {
+		ret = append(ret, NewTimerAggregateMetrica(ds, dataSourceKey, filepath.Clean(basePath)))
+	}
+	for _, tf := range stats.Funcs {
+		name, ok := timerFuncNames[tf]
+		if !ok {
+			continue
+		}
+		ret = append(ret, NewTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, name), timerFuncUnits(tf, units), tf))
+	}
+	for _, p := range stats.Percentiles {
+		ret = append(ret, NewPercentileTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, PercentileName(p)), "ms", p))
+	}
+	return ret
+}
+
+// Metricas builds the metricas of histogram dataSourceKey reported under basePath.
+func (stats HistogramStats) Metricas(ds DataSource, dataSourceKey, basePath, units string) []newrelic_platform_go.IMetrica {
+	ret := make([]newrelic_platform_go.IMetrica, 0, len(stats.Funcs)+len(stats.Percentiles)+1)
+	if stats.Aggregate {
+		ret = append(ret, NewHistogramAggregateMetrica(ds, dataSourceKey, filepath.Clean(basePath), units))
+	}
+	for _, hf := range stats.Funcs {
+		name, ok := histogramFuncNames[hf]
+		if !ok {
+			continue
+		}
+		if hf == HistogramCount {
+			ret = append(ret, NewHistogramMetrica(ds, dataSourceKey, filepath.Join(basePath, name), "samples", hf))
+			continue
+		}
+		ret = append(ret, NewHistogramMetrica(ds, dataSourceKey, filepath.Join(basePath, name), units, hf))
+	}
+	for _, p := range stats.Percentiles {
+		ret = append(ret, NewPercentileHistogramMetrica(ds, dataSourceKey, filepath.Join(basePath, PercentileName(p)), units, p))
+	}
+	return ret
+}
@@ -0,0 +1,174 @@
+package gorelic
+
+import (
+	"sync"
+	"time"
+
+	"github.com/courtf/newrelic_platform_go"
+)
+
+// AgentStats describes the health of the agent itself.
+type AgentStats struct {
+	// LastHarvestDuration is how long the last harvest (collect and send) took.
+	LastHarvestDuration time.Duration
+	// LastPayloadBytes is the size of the last payload sent to NewRelic.
+	LastPayloadBytes int
+	// MetricCount is the number of metrics reported by the last harvest.
+	MetricCount int
+	// MetricErrors is the number of metricas which failed to return a value in the last harvest.
+	MetricErrors int
+	// Harvests and HarvestFailures count all harvests and failed harvests since Run.
+	Harvests        int64
+	HarvestFailures int64
+	// ConsecutiveFailures is the number of harvests failed since the last successful one.
+	ConsecutiveFailures int
+	// LastSuccess is the time of the last harvest accepted by NewRelic.
+	LastSuccess time.Time
+	// LastError is the error of the last failed harvest.
+	LastError error
+
+	// asOf is the time stats were taken at.
+	asOf time.Time
+}
+
+// Healthy reports whether the last harvest succeeded, and did so no earlier
+// than maxAge ago.
+func (stats AgentStats) Healthy(maxAge time.Duration) bool {
+	return stats.ConsecutiveFailures == 0 && !stats.LastSuccess.IsZero() && stats.asOf.Sub(stats.LastSuccess) <= maxAge
+}
+
+// agentStats collects AgentStats during harvests.
+type agentStats struct {
+	AgentStats
+	clock        Clock
+	metricErrors int
+	// unsentFailures counts failures not yet reported by Agent/Harvest/Failures.
+	unsentFailures int
+	lk             sync.Mutex
+}
+
+func (s *agentStats) metricaError() {
+	s.lk.Lock()
+	s.metricErrors++
+	s.lk.Unlock()
+}
+
+// startHarvest resets per harvest counters.
+func (s *agentStats) startHarvest() {
+	s.lk.Lock()
+	s.metricErrors = 0
+	s.lk.Unlock()
+}
+
+func (s *agentStats) endHarvest(duration time.Duration, payloadBytes, metricCount int, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	s.Harvests++
+	s.LastHarvestDuration = duration
+	s.LastPayloadBytes = payloadBytes
+	s.MetricCount = metricCount
+	s.MetricErrors = s.metricErrors
+	if err == nil {
+		s.ConsecutiveFailures = 0
+		s.unsentFailures = 0
+		s.LastSuccess = s.clock.Now()
+		return
+	}
+
+	s.HarvestFailures++
+	s.ConsecutiveFailures++
+	s.unsentFailures++
+	s.LastError = err
+}
+
+func (s *agentStats) snapshot() AgentStats {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	stats := s.AgentStats
+	stats.asOf = s.clock.Now()
+	return stats
+}
+
+// Stats returns statistics of the agent's own harvests, e.g. for health checks.
+func (agent *Agent) Stats() AgentStats {
+	return agent.stats.snapshot()
+}
+
+// selfMetrica reports one of the agent statistics.
+type selfMetrica struct {
+	name  string
+	units string
+	stats *agentStats
+	value func(s *agentStats) float64
+}
+
+func (metrica *selfMetrica) GetName() string {
+	return metrica.name
+}
+func (metrica *selfMetrica) GetUnits() string {
+	return metrica.units
+}
+func (metrica *selfMetrica) GetValue() (float64, error) {
+	metrica.stats.lk.Lock()
+	defer metrica.stats.lk.Unlock()
+	return metrica.value(metrica.stats), nil
+}
+func (metrica *selfMetrica) ClearSentData() {
+	// no-op
+}
+
+func addSelfMetricsToComponent(component newrelic_platform_go.IComponent, stats *agentStats) {
+	metrics := []*selfMetrica{
+		{
+			name:  "Agent/Harvest/Duration",
+			units: "ms",
+			value: func(s *agentStats) float64 { return float64(s.LastHarvestDuration) / float64(time.Millisecond) },
+		},
+		// failed harvests since the last successful one
+		{
+			name:  "Agent/Harvest/Failures",
+			units: "failures",
+			value: func(s *agentStats) float64 { return float64(s.unsentFailures) },
+		},
+		{
+			name:  "Agent/Harvest/PayloadBytes",
+			units: "bytes",
+			value: func(s *agentStats) float64 { return float64(s.LastPayloadBytes) },
+		},
+		{
+			name:  "Agent/Harvest/LastSuccess",
+			units: "seconds",
+			value: func(s *agentStats) float64 {
+				if s.LastSuccess.IsZero() {
+					return 0
+				}
+				return float64(s.LastSuccess.Unix())
+			},
+		},
+		{
+			name:  "Agent/Harvest/SinceLastSuccess",
+			units: "seconds",
+			value: func(s *agentStats) float64 {
+				if s.LastSuccess.IsZero() {
+					return 0
+				}
+				return s.clock.Now().Sub(s.LastSuccess).Seconds()
+			},
+		},
+		{
+			name:  "Agent/Metrics/Count",
+			units: "metrics",
+			value: func(s *agentStats) float64 { return float64(s.MetricCount) },
+		},
+		{
+			name:  "Agent/Metrics/Errors",
+			units: "errors",
+			value: func(s *agentStats) float64 { return float64(s.MetricErrors) },
+		},
+	}
+	for _, m := range metrics {
+		m.stats = stats
+		component.AddMetrica(m)
+	}
+}
@@ -0,0 +1,68 @@
+package gorelic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAgentStatsHealthy(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		stats AgentStats
+		want  bool
+	}{
+		{"no harvest", AgentStats{}, false},
+		{"recent success", AgentStats{LastSuccess: now.Add(-30 * time.Second)}, true},
+		{"success at maxAge", AgentStats{LastSuccess: now.Add(-time.Minute)}, true},
+		{"stale success", AgentStats{LastSuccess: now.Add(-time.Minute - time.Second)}, false},
+		{"failed after success", AgentStats{LastSuccess: now, ConsecutiveFailures: 1, LastError: errors.New("503")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stats.asOf = now
+			if got := tt.stats.Healthy(time.Minute); got != tt.want {
+				t.Errorf("Healthy(1m) = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentStatsEndHarvest(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stats := agentStats{clock: &sleepClock{now: now}}
+	failure := errors.New("got 503 response code")
+
+	stats.startHarvest()
+	stats.metricaError()
+	stats.metricaError()
+	stats.endHarvest(time.Second, 100, 10, failure)
+	stats.startHarvest()
+	stats.endHarvest(time.Second, 100, 10, failure)
+
+	got := stats.snapshot()
+	if got.Harvests != 2 || got.HarvestFailures != 2 || got.ConsecutiveFailures != 2 || got.LastError != failure {
+		t.Errorf("after 2 failures: %+v", got)
+	}
+	if got.MetricErrors != 0 {
+		t.Errorf("MetricErrors = %d, want 0 after a harvest without errors", got.MetricErrors)
+	}
+	if stats.unsentFailures != 2 {
+		t.Errorf("unsent failures = %d, want 2", stats.unsentFailures)
+	}
+
+	stats.startHarvest()
+	stats.metricaError()
+	stats.endHarvest(2*time.Second, 200, 20, nil)
+	got = stats.snapshot()
+	if got.Harvests != 3 || got.HarvestFailures != 2 || got.ConsecutiveFailures != 0 || !got.LastSuccess.Equal(now) {
+		t.Errorf("after success: %+v", got)
+	}
+	if got.MetricErrors != 1 || got.MetricCount != 20 || got.LastPayloadBytes != 200 || got.LastHarvestDuration != 2*time.Second {
+		t.Errorf("per harvest stats after success: %+v", got)
+	}
+	if stats.unsentFailures != 0 {
+		t.Errorf("unsent failures = %d, want 0 after success", stats.unsentFailures)
+	}
+}
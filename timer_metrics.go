@@ -21,37 +21,23 @@ func GetTimerMeterMetrica(ds DataSource, dataSourceKey, basePath, units string)
 	}
 }
 
-func addTimerHistogramMetrics(component newrelic_platform_go.IComponent, ds DataSource, dataSourceKey, basePath string) {
-	for _, m := range GetTimerHistogramMetrica(ds, dataSourceKey, basePath) {
+func addTimerHistogramMetrics(component newrelic_platform_go.IComponent, ds DataSource, dataSourceKey, basePath string, stats TimerStats) {
+	for _, m := range stats.Metricas(ds, dataSourceKey, basePath, "calls") {
 		component.AddMetrica(m)
 	}
 }
 
+// GetTimerHistogramMetrica returns metricas of DefaultTimerStats for the timer.
+// Use TimerStats.Metricas to choose statistics and percentiles.
 func GetTimerHistogramMetrica(ds DataSource, dataSourceKey, basePath string) []newrelic_platform_go.IMetrica {
-	return []newrelic_platform_go.IMetrica{
-		NewTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, "Max"), "ms", TimerMax),
-		NewTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, "Mean"), "ms", TimerMean),
-		NewTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, "Min"), "ms", TimerMin),
-		NewPercentileTimerMetrica(ds, dataSourceKey, filepath.Join(basePath, "Percentile95"), "ms", 0.95),
-	}
+	return DefaultTimerStats.Metricas(ds, dataSourceKey, basePath, "calls")
 }
 
 func GetTimerMetrica(ds DataSource, dataSourceKey, basePath, units string) []newrelic_platform_go.IMetrica {
 	mm := GetTimerMeterMetrica(ds, dataSourceKey, basePath, units)
-	mmLen := len(mm)
 	thm := GetTimerHistogramMetrica(ds, dataSourceKey, basePath)
-	thmLen := len(thm)
-	total := mmLen + thmLen
-
-	ret := make([]newrelic_platform_go.IMetrica, 0, total)
-	for i := 0; i < total; i++ {
-		if i < mmLen {
-			ret[i] = mm[i]
-			continue
-		}
-
-		ret[i] = thm[i]
-	}
 
-	return ret
+	ret := make([]newrelic_platform_go.IMetrica, 0, len(mm)+len(thm))
+	ret = append(ret, mm...)
+	return append(ret, thm...)
 }
@@ -10,13 +10,17 @@ import (
 )
 
 type Tracer struct {
-	metrics   map[string]*TraceTransaction
-	component newrelic_platform_go.IComponent
-	ds        DataSource
+	metrics        map[string]*TraceTransaction
+	component      newrelic_platform_go.IComponent
+	ds             DataSource
+	stats          TimerStats
+	newTimer       func() metrics.Timer
+	apdexThreshold func(name string) time.Duration
 }
 
-func newTracer(component newrelic_platform_go.IComponent, ds DataSource) *Tracer {
-	return &Tracer{make(map[string]*TraceTransaction), component, ds}
+func newTracer(component newrelic_platform_go.IComponent, ds DataSource, stats TimerStats, newTimer func() metrics.Timer,
+	apdexThreshold func(name string) time.Duration) *Tracer {
+	return &Tracer{make(map[string]*TraceTransaction), component, ds, stats, newTimer, apdexThreshold}
 }
 
 func (t *Tracer) Trace(name string, traceFunc func()) {
@@ -32,29 +36,46 @@ func (t *Tracer) BeginTrace(name string) *Trace {
 	m := t.metrics[basePath]
 	if m == nil {
 		srcKey := "gorelic.trace." + name
-		timer := metrics.NewTimer()
+		timer := t.newTimer()
 		t.ds.Register(srcKey, timer)
-		m = &TraceTransaction{timer, srcKey, basePath}
+		m = &TraceTransaction{timer: timer, dataSourceKey: srcKey, basePath: basePath}
+		if threshold := t.apdexThreshold(name); threshold > 0 {
+			m.apdex = newApdexCounters(t.ds, apdexDataSourceKey+"trace."+name)
+			m.apdexThreshold = threshold
+		}
 		t.metrics[basePath] = m
-		m.addMetricsToComponent(t.component, t.ds)
+		m.addMetricsToComponent(t.component, t.ds, t.stats)
 	}
-	return &Trace{m, time.Now()}
+	clock := clockOf(t.ds)
+	return &Trace{m, clock, clock.Now()}
 }
 
 type Trace struct {
 	transaction *TraceTransaction
+	clock       Clock
 	startTime   time.Time
 }
 
 func (t *Trace) EndTrace() {
-	t.transaction.timer.UpdateSince(t.startTime)
+	d := t.clock.Now().Sub(t.startTime)
+	t.transaction.timer.Update(d)
+	if t.transaction.apdex != nil {
+		t.transaction.apdex.record(apdexZone(d, t.transaction.apdexThreshold, false))
+	}
 }
 
 type TraceTransaction struct {
 	timer                   metrics.Timer
 	dataSourceKey, basePath string
+	apdex                   *apdexCounters
+	apdexThreshold          time.Duration
 }
 
-func (transaction *TraceTransaction) addMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource) {
-	addTimerHistogramMetrics(component, ds, transaction.dataSourceKey, transaction.basePath)
+func (transaction *TraceTransaction) addMetricsToComponent(component newrelic_platform_go.IComponent, ds DataSource, stats TimerStats) {
+	addTimerHistogramMetrics(component, ds, transaction.dataSourceKey, transaction.basePath, stats)
+	if transaction.apdex != nil {
+		for _, m := range transaction.apdex.metricas(filepath.Join("Apdex", transaction.basePath), "calls") {
+			component.AddMetrica(m)
+		}
+	}
 }
@@ -0,0 +1,253 @@
+package gorelic
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/courtf/go-metrics"
+	"github.com/courtf/newrelic_platform_go"
+)
+
+const transactionDataSourceKey = "gorelic.transaction." // add name and segment to the end
+
+// maxTransactionSegments - how many segment times a single transaction keeps,
+// further segments are not reported.
+const maxTransactionSegments = 1000
+
+type transactionKey struct{}
+
+// Transaction is a request served by a wrapped HTTP handler, see
+// Agent.RequestTransactions. Its methods may be called on a nil Transaction,
+// so handlers do not need to check the result of FromContext.
+type Transaction struct {
+	clock Clock
+
+	lk         sync.Mutex
+	name       string
+	attributes map[string]interface{}
+	err        error
+	segments   []segmentTime
+}
+
+type segmentTime struct {
+	name string
+	d    time.Duration
+}
+
+func newTransaction(clock Clock) *Transaction {
+	return &Transaction{clock: clock}
+}
+
+// FromContext returns the transaction of the request ctx belongs to, or nil.
+func FromContext(ctx context.Context) *Transaction {
+	txn, _ := ctx.Value(transactionKey{}).(*Transaction)
+	return txn
+}
+
+// Segment starts timing a part of the request, e.g. a database query:
+//
+//	defer gorelic.FromContext(ctx).Segment("db").End()
+//
+// Segment times are reported once the request is served, under
+// Transaction/<name>/<segment>/ with the statistics of Agent.TimerStats.
+// Like labels, segment names should not contain request specific values:
+// only DefaultCardinalityLimit segments per name are reported separately.
+func (txn *Transaction) Segment(name string) *Segment {
+	if txn == nil {
+		return nil
+	}
+	return &Segment{txn, strings.Trim(name, "/"), txn.clock.Now()}
+}
+
+// SetName renames the transaction. The name is used instead of the route in
+// per route metrics, segment metrics and the slow request log, so it should
+// not contain request specific values like IDs.
+func (txn *Transaction) SetName(name string) {
+	if txn == nil {
+		return
+	}
+	txn.lk.Lock()
+	txn.name = name
+	txn.lk.Unlock()
+}
+
+// Name returns the name set by SetName.
+func (txn *Transaction) Name() string {
+	if txn == nil {
+		return ""
+	}
+	txn.lk.Lock()
+	defer txn.lk.Unlock()
+	return txn.name
+}
+
+// AddAttribute adds a custom attribute. Attributes are reported with the
+// request in the slow request log.
+func (txn *Transaction) AddAttribute(key string, value interface{}) {
+	if txn == nil {
+		return
+	}
+	txn.lk.Lock()
+	if txn.attributes == nil {
+		txn.attributes = make(map[string]interface{})
+	}
+	txn.attributes[key] = value
+	txn.lk.Unlock()
+}
+
+// NoticeError marks the transaction as failed. It is counted under
+// HTTP/Errors, is frustrating for Apdex and err is reported in the slow
+// request log. Only the last error is kept.
+func (txn *Transaction) NoticeError(err error) {
+	if txn == nil || err == nil {
+		return
+	}
+	txn.lk.Lock()
+	txn.err = err
+	txn.lk.Unlock()
+}
+
+// Err returns the error passed to NoticeError.
+func (txn *Transaction) Err() error {
+	if txn == nil {
+		return nil
+	}
+	txn.lk.Lock()
+	defer txn.lk.Unlock()
+	return txn.err
+}
+
+func (txn *Transaction) attributesCopy() map[string]interface{} {
+	if txn == nil {
+		return nil
+	}
+	txn.lk.Lock()
+	defer txn.lk.Unlock()
+	if txn.attributes == nil {
+		return nil
+	}
+	attributes := make(map[string]interface{}, len(txn.attributes))
+	for k, v := range txn.attributes {
+		attributes[k] = v
+	}
+	return attributes
+}
+
+func (txn *Transaction) hasSegments() bool {
+	if txn == nil {
+		return false
+	}
+	txn.lk.Lock()
+	defer txn.lk.Unlock()
+	return len(txn.segments) > 0
+}
+
+// Segment is a timed part of a transaction.
+type Segment struct {
+	txn       *Transaction
+	name      string
+	startTime time.Time
+}
+
+// End stops timing the segment.
+func (s *Segment) End() {
+	if s == nil {
+		return
+	}
+	d := s.txn.clock.Now().Sub(s.startTime)
+
+	s.txn.lk.Lock()
+	if len(s.txn.segments) < maxTransactionSegments {
+		s.txn.segments = append(s.txn.segments, segmentTime{s.name, d})
+	}
+	s.txn.lk.Unlock()
+}
+
+// transactionTimers creates segment timers when they are first used and
+// reports them as a MetricaSource. Like labeled series, it keeps at most limit
+// transaction names and limit segments per name; further ones are reported
+// under the overflow name or segment.
+type transactionTimers struct {
+	ds       DataSource
+	stats    TimerStats
+	newTimer func() metrics.Timer
+	limit    int
+
+	lk       sync.Mutex
+	timers   map[string]metrics.Timer
+	segments map[string]int // segment count by transaction name
+	metricas []newrelic_platform_go.IMetrica
+}
+
+const (
+	// unnamedTransaction names transactions of requests without a route
+	unnamedTransaction = "(unnamed)"
+	// overflowTransaction collects transaction names and segments beyond the
+	// cardinality limit
+	overflowTransaction = "(overflow)"
+)
+
+func newTransactionTimers(ds DataSource, stats TimerStats, newTimer func() metrics.Timer) *transactionTimers {
+	return &transactionTimers{
+		ds:       ds,
+		stats:    stats,
+		newTimer: newTimer,
+		limit:    DefaultCardinalityLimit,
+		timers:   make(map[string]metrics.Timer),
+		segments: make(map[string]int),
+	}
+}
+
+// record updates the timers of the segments of txn, reported under name.
+func (t *transactionTimers) record(name string, txn *Transaction) {
+	txn.lk.Lock()
+	segments := txn.segments
+	txn.segments = nil
+	txn.lk.Unlock()
+
+	if name == "" {
+		name = unnamedTransaction
+	} else {
+		name = pathSegment(name)
+	}
+	for _, s := range segments {
+		t.timer(name, pathSegment(s.name)).Update(s.d)
+	}
+}
+
+func (t *transactionTimers) timer(name, segment string) metrics.Timer {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	path := filepath.Join("Transaction", name, segment)
+	if timer, ok := t.timers[path]; ok {
+		return timer
+	}
+
+	if _, ok := t.segments[name]; !ok && len(t.segments) >= t.limit {
+		name = overflowTransaction
+	}
+	if t.segments[name] >= t.limit {
+		segment = overflowTransaction
+	}
+	path = filepath.Join("Transaction", name, segment)
+	if timer, ok := t.timers[path]; ok {
+		return timer
+	}
+
+	key := transactionDataSourceKey + path
+	timer := t.newTimer()
+	t.ds.Register(key, timer)
+	t.timers[path] = timer
+	t.segments[name]++
+	t.metricas = append(t.metricas, t.stats.Metricas(t.ds, key, path, "calls")...)
+	return timer
+}
+
+func (t *transactionTimers) Metricas() []newrelic_platform_go.IMetrica {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return append([]newrelic_platform_go.IMetrica(nil), t.metricas...)
+}
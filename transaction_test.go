@@ -0,0 +1,70 @@
+package gorelic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/courtf/go-metrics"
+)
+
+func newTestTransactionTimers(limit int) *transactionTimers {
+	t := newTransactionTimers(NewDataSource(metrics.NewRegistry()), TimerStats{}, metrics.NewTimer)
+	t.limit = limit
+	return t
+}
+
+func recordSegments(timers *transactionTimers, name string, segments ...string) {
+	txn := newTransaction(SystemClock)
+	for _, s := range segments {
+		txn.segments = append(txn.segments, segmentTime{s, time.Millisecond})
+	}
+	timers.record(name, txn)
+}
+
+func TestTransactionTimerNames(t *testing.T) {
+	timers := newTestTransactionTimers(DefaultCardinalityLimit)
+	recordSegments(timers, "", "db")
+	recordSegments(timers, "GET /users/{id}", "cache/get", "")
+
+	for _, path := range []string{
+		"Transaction/(unnamed)/db",
+		"Transaction/GET _users_{id}/cache_get",
+		"Transaction/GET _users_{id}/_",
+	} {
+		if _, ok := timers.timers[path]; !ok {
+			t.Errorf("no timer %s in %v", path, timers.timers)
+		}
+	}
+}
+
+func TestTransactionTimerOverflow(t *testing.T) {
+	timers := newTestTransactionTimers(2)
+	for i := 0; i < 4; i++ {
+		recordSegments(timers, fmt.Sprint("name", i), "db")
+	}
+	for i := 0; i < 4; i++ {
+		recordSegments(timers, "name0", fmt.Sprint("segment", i))
+	}
+
+	want := map[string]int64{
+		"Transaction/name0/db":         1,
+		"Transaction/name0/segment0":   1,
+		"Transaction/name0/(overflow)": 3,
+		"Transaction/name1/db":         1,
+		"Transaction/(overflow)/db":    2,
+	}
+	if len(timers.timers) != len(want) {
+		t.Errorf("got timers %v, want %v", timers.timers, want)
+	}
+	for path, count := range want {
+		timer, ok := timers.timers[path]
+		if !ok {
+			t.Errorf("no timer %s", path)
+			continue
+		}
+		if timer.Count() != count {
+			t.Errorf("%s count = %d, want %d", path, timer.Count(), count)
+		}
+	}
+}